@@ -0,0 +1,115 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// addrIP returns the IP address of addr, or nil if it does not have one.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	case *net.IPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+func contains(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// permitted reports whether a connection from addr should be accepted
+// according to the listener's Allow and Deny networks.  Allow takes
+// precedence over Deny, and if there are no Deny networks, Allow alone
+// decides.  Addresses without an IP (such as those of Unix sockets) are
+// always permitted.
+func (w *WaitListener) permitted(addr net.Addr) bool {
+	if len(w.Allow) == 0 && len(w.Deny) == 0 {
+		return true
+	}
+	ip := addrIP(addr)
+	if ip == nil {
+		return true
+	}
+	if contains(w.Allow, ip) {
+		return true
+	}
+	if len(w.Deny) == 0 {
+		// An allow list on its own denies everything else
+		return false
+	}
+	return !contains(w.Deny, ip)
+}
+
+// A cidrList is a flag value holding a list of networks.
+type cidrList []*net.IPNet
+
+func (c *cidrList) String() string {
+	var s []string
+	for _, n := range *c {
+		s = append(s, n.String())
+	}
+	return strings.Join(s, ",")
+}
+
+func (c *cidrList) Set(s string) error {
+	for _, cidr := range strings.Split(s, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("bad network %q: %s", cidr, err)
+		}
+		*c = append(*c, n)
+	}
+	return nil
+}
+
+// AllowDenyFlags registers two flags with the given names which control the
+// networks from which connections to l will be accepted.  Each may be
+// provided more than once or given a comma-separated list of networks in
+// CIDR notation (e.g. "--echo-allow=10.0.0.0/8 --echo-deny=0.0.0.0/0,::/0").
+// Connections from allowed networks are always accepted; otherwise,
+// connections from denied networks are logged and closed.  If only allowed
+// networks are given, connections from all other networks are closed.  See
+// WaitListener.Allow and WaitListener.Deny.
+func AllowDenyFlags(l Listenable, allowName, denyName string) {
+	c, ok := l.(configurable)
+	if !ok {
+		Fatal.Printf("cannot configure networks for %T", l)
+	}
+
+	allow, deny := new(cidrList), new(cidrList)
+	FlagSet.Var(allow, allowName, "Networks (CIDR) from which connections are always accepted")
+	FlagSet.Var(deny, denyName, "Networks (CIDR) from which connections are rejected unless allowed")
+	c.configure(func(w *WaitListener) {
+		w.Allow = append(w.Allow, *allow...)
+		w.Deny = append(w.Deny, *deny...)
+	})
+}
@@ -0,0 +1,66 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// cpuMask is a CPU affinity mask, as used by sched_setaffinity.
+type cpuMask [1024 / 64]uint64
+
+func schedAffinity(trap uintptr, mask *cpuMask) error {
+	_, _, errno := syscall.RawSyscall(trap, 0, unsafe.Sizeof(*mask), uintptr(unsafe.Pointer(mask)))
+	if errno != 0 {
+		return os.NewSyscallError("sched_affinity", errno)
+	}
+	return nil
+}
+
+// withAffinity calls fn, which starts a process, on an OS thread which is
+// restricted to the given CPUs, so that the process inherits the affinity.
+func withAffinity(cpus []int, fn func()) error {
+	if len(cpus) == 0 {
+		fn()
+		return nil
+	}
+
+	var mask cpuMask
+	for _, cpu := range cpus {
+		if cpu < 0 || cpu >= len(mask)*64 {
+			return fmt.Errorf("CPU %d out of range", cpu)
+		}
+		mask[cpu/64] |= 1 << uint(cpu%64)
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	var orig cpuMask
+	if err := schedAffinity(syscall.SYS_SCHED_GETAFFINITY, &orig); err != nil {
+		return err
+	}
+	if err := schedAffinity(syscall.SYS_SCHED_SETAFFINITY, &mask); err != nil {
+		return err
+	}
+	defer schedAffinity(syscall.SYS_SCHED_SETAFFINITY, &orig)
+
+	fn()
+	return nil
+}
@@ -0,0 +1,164 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Command interprets the first positional argument as a command for the
+// instance of the daemon which holds the pidfile, so that the binary can
+// also be used to control it, like an init script:
+//
+//	start     - Returns, so that the daemon starts as usual
+//	stop      - Sends it a shutdown signal and waits for it to exit
+//	status    - Reports whether it is running
+//	reload    - Sends it a reload signal (see ActionReload)
+//	restart   - Sends it a restart signal, or starts it if it isn't running
+//
+// Except where noted, Command exits once the command is done, with status 0
+// if it succeeded, 3 if the daemon isn't running (for status), or 1 if it
+// failed.  If there is no positional argument or it is not a command,
+// Command returns.  It should be called after the flags are parsed and before
+// Fork.  The command is not passed on to processes started by Restart or
+// Fork, and Command does nothing in them.
+func (f *forkFlag) Command() {
+	if Generation() > 0 || os.Getenv(PIDFileEnv) != "" {
+		return
+	}
+	cmd := FlagSet.Arg(0)
+	switch cmd {
+	case "start":
+		commandArgs = 1
+		return
+	case "stop", "status", "reload", "restart":
+		commandArgs = 1
+	default:
+		return
+	}
+
+	pid, running, err := readPIDFile(f.pidfile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", cmd, err)
+		os.Exit(1)
+	}
+	if !running {
+		switch cmd {
+		case "restart":
+			fmt.Println("Not running; starting")
+			return
+		case "status":
+			fmt.Println("Not running")
+			os.Exit(3)
+		}
+		fmt.Println("Not running")
+		os.Exit(0)
+	}
+
+	switch cmd {
+	case "status":
+		fmt.Printf("Running (pid %d)\n", pid)
+		os.Exit(0)
+	case "stop":
+		err = signalPID(pid, ActionShutdown)
+		if err == nil {
+			err = waitPIDFile(f.pidfile, LameDuck+5*time.Second)
+		}
+	case "reload":
+		err = signalPID(pid, ActionReload)
+	case "restart":
+		err = signalPID(pid, ActionRestart)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", cmd, err)
+		os.Exit(1)
+	}
+	if cmd == "stop" {
+		fmt.Printf("Stopped (pid %d)\n", pid)
+	} else {
+		fmt.Printf("Sent %s to pid %d\n", cmd, pid)
+	}
+	os.Exit(0)
+}
+
+// commandArgs is the number of positional arguments consumed by Command,
+// which are not passed on by copyFlags.
+var commandArgs int
+
+// readPIDFile returns the PID in the pidfile at path, and whether the process
+// which wrote it is still running and holds it.
+func readPIDFile(path string) (pid int, running bool, err error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	defer file.Close()
+
+	b, err := ioutil.ReadAll(file)
+	if err != nil {
+		return 0, false, err
+	}
+	s := strings.TrimSpace(string(b))
+	if s == "" {
+		return 0, false, nil
+	}
+	if pid, err = strconv.Atoi(s); err != nil {
+		return 0, false, fmt.Errorf("bad pidfile %s: %s", path, err)
+	}
+
+	switch err := lockFile(file, s); err { // provided in OS-specific files
+	case nil:
+		return pid, false, nil
+	case errLocked:
+		return pid, true, nil
+	default:
+		return 0, false, err
+	}
+}
+
+// waitPIDFile waits up to timeout for the process holding the pidfile at
+// path to exit.
+func waitPIDFile(path string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if _, running, err := readPIDFile(path); err != nil || !running {
+			return err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("still running after %s", timeout)
+}
+
+// signalPID sends the process with the given pid a signal for which the
+// action is action.
+func signalPID(pid int, action Action) error {
+	sig, ok := actionSignal(action)
+	if !ok {
+		return errors.New("no signal is handled by that action")
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return p.Signal(sig)
+}
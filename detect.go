@@ -0,0 +1,100 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// AutoDetect, if set, causes the daemon to adapt to being run by systemd or
+// in a container (see ManagedBy), whose managers track the process, collect
+// its output, and restart it themselves.  When it is, Fork neither forks nor
+// writes a pidfile, LogFileFlag is ignored so that logs go only to standard
+// error, and under systemd, Run reports to the notification socket when the
+// process is ready (along with its PID, so that systemd follows it across a
+// Restart) and when it begins to shut down.
+//
+// It must be set before the flags are parsed.  Units which use it should
+// have Type=notify (and NotifyAccess=all, if they use Restart) or
+// Type=simple, rather than Type=forking.
+var AutoDetect = false
+
+var (
+	managerOnce sync.Once
+	manager     string
+)
+
+// ManagedBy returns "systemd" if the process was started by systemd, the
+// name of the container runtime (or just "container") if it is running in a
+// container, or "" if neither is detected.
+func ManagedBy() string {
+	managerOnce.Do(func() {
+		manager = detectManager()
+	})
+	return manager
+}
+
+func detectManager() string {
+	if os.Getenv("INVOCATION_ID") != "" || os.Getenv("NOTIFY_SOCKET") != "" {
+		return "systemd"
+	}
+	if _, err := os.Stat("/.dockerenv"); err == nil {
+		return "docker"
+	}
+	if _, err := os.Stat("/run/.containerenv"); err == nil {
+		return "podman"
+	}
+	// Set by systemd-nspawn, podman, lxc and others
+	if c := os.Getenv("container"); c != "" {
+		return c
+	}
+	if cgroup, err := os.ReadFile("/proc/1/cgroup"); err == nil {
+		for _, runtime := range []string{"docker", "kubepods", "containerd", "lxc"} {
+			if strings.Contains(string(cgroup), runtime) {
+				return "container"
+			}
+		}
+	}
+	return ""
+}
+
+// managed returns the manager detected by ManagedBy, if AutoDetect is set.
+func managed() (string, bool) {
+	if !AutoDetect {
+		return "", false
+	}
+	m := ManagedBy()
+	return m, m != ""
+}
+
+// notify sends state to systemd, if AutoDetect is set and the process was
+// started by systemd.  Supervised workers leave it to their supervisor.
+func notify(state string) {
+	if m, _ := managed(); m != "systemd" || worker != 0 {
+		return
+	}
+	if err := sdNotify(state); err != nil {
+		Warning.Printf("Failed to notify systemd: %s", err)
+	}
+}
+
+// notifyReady tells systemd that this process is ready and is now the main
+// process of the service.
+func notifyReady() {
+	notify(fmt.Sprintf("READY=1\nMAINPID=%d", os.Getpid()))
+}
@@ -0,0 +1,390 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A multiAddr is the address of a multiListener.  Its String form is a
+// comma-separated list of the addresses, as accepted by a DualListenFlag.
+type multiAddr []net.Addr
+
+func (a multiAddr) Network() string { return a[0].Network() }
+
+func (a multiAddr) String() string {
+	strs := make([]string, len(a))
+	for i, addr := range a {
+		strs[i] = addr.String()
+	}
+	return strings.Join(strs, ",")
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// A multiListener accepts connections from several listeners at once.
+// Each listener is served by its own goroutine, and deadlines are applied
+// both to the multiListener and to the listeners themselves so that an
+// expired deadline also interrupts their Accepts.  The listeners only accept
+// connections while an Accept is waiting for one, so that connections are
+// left to the listeners' backlogs (and so to the next process) once the
+// multiListener is no longer accepting.
+type multiListener struct {
+	ls   []net.Listener
+	done chan bool
+
+	mu      sync.Mutex
+	timer   *time.Timer
+	expired chan bool      // closed when the deadline passes
+	reset   chan bool      // closed when the deadline changes
+	waiting int            // number of Accepts waiting for a connection
+	active  int            // number of listeners in Accept
+	pending []acceptResult // accepted, but not yet returned by Accept
+	changed chan bool      // closed when waiting, active or pending change
+}
+
+func newMultiListener(ls ...net.Listener) *multiListener {
+	m := &multiListener{
+		ls:      ls,
+		done:    make(chan bool),
+		reset:   make(chan bool),
+		changed: make(chan bool),
+	}
+	for _, l := range ls {
+		go m.serve(l)
+	}
+	return m
+}
+
+// notify wakes everything waiting for a change.  The lock must be held.
+func (m *multiListener) notify() {
+	close(m.changed)
+	m.changed = make(chan bool)
+}
+
+// serve accepts connections from l until it fails permanently.
+func (m *multiListener) serve(l net.Listener) {
+	for {
+		m.mu.Lock()
+		if m.waiting <= len(m.pending) {
+			// Nothing is waiting for another connection
+			changed := m.changed
+			m.mu.Unlock()
+			select {
+			case <-changed:
+				continue
+			case <-m.done:
+				return
+			}
+		}
+		reset := m.reset
+		m.active++
+		m.mu.Unlock()
+
+		conn, err := l.Accept()
+
+		m.mu.Lock()
+		m.active--
+		expired := errors.Is(err, os.ErrDeadlineExceeded)
+		closed := false
+		select {
+		case <-m.done:
+			closed = true
+		default:
+			if !expired {
+				m.pending = append(m.pending, acceptResult{conn, err})
+			}
+		}
+		m.notify()
+		m.mu.Unlock()
+
+		if closed {
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		if expired {
+			// Wait for the deadline to be moved
+			select {
+			case <-reset:
+				continue
+			case <-m.done:
+				return
+			}
+		}
+		if ne, ok := err.(net.Error); err != nil && (!ok || !ne.Temporary()) {
+			return
+		}
+	}
+}
+
+func (m *multiListener) Accept() (net.Conn, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.waiting++
+	m.notify()
+	defer func() { m.waiting-- }()
+
+	for {
+		if len(m.pending) > 0 {
+			r := m.pending[0]
+			m.pending = m.pending[1:]
+			return r.conn, r.err
+		}
+
+		select {
+		case <-m.done:
+			return nil, &net.OpError{Op: "accept", Net: m.Addr().Network(), Addr: m.Addr(), Err: net.ErrClosed}
+		default:
+		}
+
+		changed, expired, reset := m.changed, m.expired, m.reset
+		select {
+		case <-expired:
+			// The listeners' deadlines interrupt their Accepts too; wait
+			// for them, so that a connection accepted as the deadline
+			// passed is returned rather than left behind.
+			if m.active == 0 {
+				return nil, &net.OpError{Op: "accept", Net: m.Addr().Network(), Addr: m.Addr(), Err: os.ErrDeadlineExceeded}
+			}
+			expired = nil
+		default:
+		}
+		m.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-reset:
+			// The deadline changed
+		case <-expired:
+		case <-m.done:
+		}
+		m.mu.Lock()
+	}
+}
+
+// SetDeadline sets the deadline for Accept on the multiListener and on
+// each of its listeners.
+func (m *multiListener) SetDeadline(t time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.timer != nil {
+		m.timer.Stop()
+		m.timer = nil
+	}
+	m.expired = nil
+	if !t.IsZero() {
+		expired := make(chan bool)
+		if d := time.Until(t); d <= 0 {
+			close(expired)
+		} else {
+			m.timer = time.AfterFunc(d, func() { close(expired) })
+		}
+		m.expired = expired
+	}
+
+	var err error
+	for _, l := range m.ls {
+		dl, ok := l.(deadliner)
+		if !ok {
+			return fmt.Errorf("deadlines not supported by %T", l)
+		}
+		if derr := dl.SetDeadline(t); err == nil {
+			err = derr
+		}
+	}
+	close(m.reset)
+	m.reset = make(chan bool)
+	return err
+}
+
+func (m *multiListener) Close() error {
+	m.mu.Lock()
+	select {
+	case <-m.done:
+	default:
+		close(m.done)
+	}
+	for _, r := range m.pending {
+		if r.conn != nil {
+			r.conn.Close()
+		}
+	}
+	m.pending = nil
+	m.mu.Unlock()
+
+	var err error
+	for _, l := range m.ls {
+		if cerr := l.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (m *multiListener) Addr() net.Addr {
+	addrs := make(multiAddr, len(m.ls))
+	for i, l := range m.ls {
+		addrs[i] = l.Addr()
+	}
+	return addrs
+}
+
+type dualFlag struct {
+	flag, proto string
+	v4, v6      *listenFlag
+	under       []net.Listener
+	listener    *WaitListener
+
+	// setup is applied to the listener when it is created
+	setup []func(*WaitListener)
+}
+
+func (d *dualFlag) Listen() (net.Listener, error) {
+	l4, err := d.v4.bind()
+	if err != nil {
+		return nil, err
+	}
+
+	// Listen on the same port for IPv6 if the port was chosen for IPv4
+	if d.v4.mode != "fd" && d.v6.mode != "fd" && (d.v6.laddr.Port == 0 || d.v6.lastPort != 0) {
+		laddr := *d.v6.laddr
+		laddr.Port = l4.Addr().(*net.TCPAddr).Port
+		d.v6.laddr, d.v6.lastPort = &laddr, 0
+	}
+
+	l6, err := d.v6.bind()
+	if err != nil {
+		l4.Close()
+		return nil, err
+	}
+
+	d.under = []net.Listener{l4, l6}
+	under := newMultiListener(l4, l6)
+	Verbose.Printf("Listening for %s on: %s (from %s, %s)", d.proto, under.Addr(), d.v4.mode, d.v6.mode)
+	listener := NewWaitListener(under)
+	for _, fn := range d.setup {
+		fn(listener)
+	}
+	d.listener = listener
+	return listener, nil
+}
+
+// files copies the file descriptors of the IPv4 and IPv6 listeners.
+func (d *dualFlag) files() []*os.File {
+	var files []*os.File
+	for _, l := range d.under {
+		fl, ok := l.(filer)
+		if !ok {
+			Fatal.Printf("unknown listener type: %T", l)
+		}
+		f, err := fl.File()
+		if err != nil {
+			Fatal.Printf("failed to get fd: %s", err)
+		}
+		files = append(files, f)
+	}
+	return files
+}
+
+func (d *dualFlag) configure(fn func(*WaitListener)) {
+	d.setup = append(d.setup, fn)
+}
+
+func (d *dualFlag) Addr() net.Addr {
+	if d.listener == nil {
+		return nil
+	}
+	return d.listener.Addr()
+}
+
+func (d *dualFlag) String() string {
+	if d.listener != nil {
+		return d.listener.Addr().String()
+	}
+	if d.v4 == nil {
+		return ""
+	}
+	if v4, v6 := d.v4.String(), d.v6.String(); v4 != v6 {
+		return v4 + "," + v6
+	}
+	return d.v4.String()
+}
+
+func (d *dualFlag) Set(s string) error {
+	if len(s) == 0 {
+		return fmt.Errorf("--%s requires an argument", d.flag)
+	}
+	v4, v6, ok := strings.Cut(s, ",")
+	if !ok {
+		v6 = v4
+	}
+	if err := d.v4.Set(v4); err != nil {
+		return err
+	}
+	return d.v6.Set(v6)
+}
+
+// DualListenFlag is like ListenFlag, but the returned Listenable listens
+// on separate IPv4 and IPv6 sockets and accepts connections from both, so
+// that the result doesn't depend on the platform's dual-stack behavior.
+// The netw must be "tcp" or "sctp".
+//
+// The address is resolved separately for each family, so ":80" listens on
+// both wildcard addresses and "localhost:80" listens on both loopback
+// addresses; separate addresses may be given separated by a comma, as in
+// "10.0.0.1:80,[fd00::1]:80".  If the IPv4 port is chosen by the system,
+// the same port is used for IPv6.  Restart passes both sockets on to the
+// new process.
+//
+// The Addr of the listener lists both addresses, separated by a comma.
+func DualListenFlag(name, netw, addr, proto string) Listenable {
+	if netw != "tcp" && netw != "sctp" {
+		Fatal.Printf("cannot listen on separate sockets for %s", netw)
+	}
+
+	family := func(netw string) *listenFlag {
+		return &listenFlag{
+			flag:   name,
+			proto:  proto,
+			net:    netw,
+			defNet: netw,
+		}
+	}
+	d := &dualFlag{
+		flag:  name,
+		proto: proto,
+		v4:    family(netw + "4"),
+		v6:    family(netw + "6"),
+	}
+	if err := d.Set(addr); err != nil {
+		Fatal.Printf("failed to resolve default %q: %s", addr, err)
+	}
+	inherit(name, d)
+	FlagSet.Var(d, name, fmt.Sprintf("Address on which to listen for %s", proto))
+	return d
+}
@@ -0,0 +1,107 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"errors"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// fdExhausted reports whether err indicates that the process or system has
+// run out of file descriptors.
+func fdExhausted(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE)
+}
+
+// setExhausted records whether the listener is out of file descriptors and
+// logs when it enters or leaves that state.
+func (w *WaitListener) setExhausted(exhausted bool) {
+	now := time.Now().UnixNano()
+	if exhausted {
+		if atomic.CompareAndSwapInt64(&w.exhaustedSince, 0, now) {
+			Warning.Printf("Out of file descriptors; pausing accept on %s", w.Addr())
+		}
+		return
+	}
+	if since := atomic.SwapInt64(&w.exhaustedSince, 0); since != 0 {
+		Info.Printf("Resuming accept on %s after %s", w.Addr(), time.Duration(now-since))
+	}
+}
+
+// reserveSpare opens the spare file descriptor, if one is wanted.
+func (w *WaitListener) reserveSpare() {
+	if !w.SpareFD {
+		return
+	}
+	w.spareMu.Lock()
+	defer w.spareMu.Unlock()
+	if w.spare != nil || w.spareClosed {
+		return
+	}
+	spare, err := os.Open(os.DevNull)
+	if err != nil {
+		Verbose.Printf("Failed to reserve spare fd: %s", err)
+		return
+	}
+	w.spare = spare
+}
+
+// releaseSpare closes the spare file descriptor for good.
+func (w *WaitListener) releaseSpare() {
+	w.spareMu.Lock()
+	defer w.spareMu.Unlock()
+	if w.spare != nil {
+		w.spare.Close()
+		w.spare = nil
+	}
+	w.spareClosed = true
+}
+
+// shed uses the spare file descriptor to accept and immediately close a
+// pending connection, so that the client gets an error instead of waiting
+// for the file descriptor shortage to end.  It returns whether a connection
+// was shed.
+func (w *WaitListener) shed() bool {
+	w.spareMu.Lock()
+	if w.spare == nil {
+		w.spareMu.Unlock()
+		return false
+	}
+	w.spare.Close()
+	w.spare = nil
+	w.spareMu.Unlock()
+
+	// Don't hold the lock while accepting, since Stop needs it
+	defer func() {
+		w.spareMu.Lock()
+		defer w.spareMu.Unlock()
+		if w.spare == nil && !w.spareClosed {
+			w.spare, _ = os.Open(os.DevNull)
+		}
+	}()
+
+	conn, err := w.Listener.Accept()
+	if err != nil {
+		return false
+	}
+	atomic.AddInt64(&w.shedConns, 1)
+	Verbose.Printf("Shed connection: (local) %s <- %s (remote)",
+		conn.LocalAddr(), conn.RemoteAddr())
+	conn.Close()
+	return true
+}
@@ -0,0 +1,37 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+type eventLogFlag struct {
+	source string
+}
+
+func (f *eventLogFlag) String() string {
+	return f.source
+}
+
+func (f *eventLogFlag) Set(s string) error {
+	if err := EventLog(s); err != nil {
+		return err
+	}
+	f.source = s
+	return nil
+}
+
+// EventLogFlag registers a flag with the given name which, when set to the
+// name of an event source, calls EventLog with it.
+func EventLogFlag(name string) {
+	FlagSet.Var(&eventLogFlag{}, name, "Windows Event Log source to which to send logs")
+}
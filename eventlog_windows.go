@@ -0,0 +1,142 @@
+// +build windows
+
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var (
+	procRegisterEventSourceW = modadvapi32.NewProc("RegisterEventSourceW")
+	procReportEventW         = modadvapi32.NewProc("ReportEventW")
+	procRegCreateKeyExW      = modadvapi32.NewProc("RegCreateKeyExW")
+	procRegSetValueExW       = modadvapi32.NewProc("RegSetValueExW")
+	procRegDeleteKeyW        = modadvapi32.NewProc("RegDeleteKeyW")
+)
+
+const (
+	eventlogErrorType       = 0x1
+	eventlogWarningType     = 0x2
+	eventlogInformationType = 0x4
+
+	keySetValue = 0x2
+	regExpandSz = 2
+	regDword    = 4
+
+	// The message file of EventCreate.exe formats event IDs 1 to 1000 as
+	// the single string given with the event.
+	eventMessageFile = `%SystemRoot%\System32\EventCreate.exe`
+	eventID          = 1
+)
+
+// eventSourceKey is the registry key, under HKEY_LOCAL_MACHINE, which
+// registers the event source with the given name.
+func eventSourceKey(source string) string {
+	return `SYSTEM\CurrentControlSet\Services\EventLog\Application\` + source
+}
+
+// EventLog causes Error, Warning, and Info messages (including those at Fatal
+// and Exit) to be written to the Windows Event Log, as events of the
+// corresponding type from the given source, in addition to standard error and
+// the LogFileFlag file.  Messages are written regardless of the LogFormat,
+// with the file and line which logged them.
+//
+// The source should be registered, so that Event Viewer can display its
+// messages; ServiceFlags does so for ServiceName when it installs the service.
+func EventLog(source string) error {
+	sourcep, err := syscall.UTF16PtrFromString(source)
+	if err != nil {
+		return err
+	}
+	h, _, err := procRegisterEventSourceW.Call(0, uintptr(unsafe.Pointer(sourcep)))
+	if h == 0 {
+		return err
+	}
+	addLogSink(logSink{
+		write: func(e *logEntry) { reportEvent(h, e) },
+	})
+	return nil
+}
+
+// reportEvent writes e to the event source h, unless it is Verbose.
+func reportEvent(h uintptr, e *logEntry) {
+	var typ uintptr
+	switch severity(e.level) {
+	case sevCrit, sevErr:
+		typ = eventlogErrorType
+	case sevWarning:
+		typ = eventlogWarningType
+	case sevInfo:
+		typ = eventlogInformationType
+	default:
+		return
+	}
+	msg, err := syscall.UTF16PtrFromString(withSource(e))
+	if err != nil {
+		return
+	}
+	strs := []*uint16{msg}
+	procReportEventW.Call(h, typ, 0, eventID, 0, 1, 0, uintptr(unsafe.Pointer(&strs[0])), 0)
+}
+
+// registerEventSource registers the event source with the given name in the
+// Application log, using the EventCreate.exe message file.
+func registerEventSource(source string) error {
+	keyp, err := syscall.UTF16PtrFromString(eventSourceKey(source))
+	if err != nil {
+		return err
+	}
+	var key syscall.Handle
+	if r, _, _ := procRegCreateKeyExW.Call(uintptr(syscall.HKEY_LOCAL_MACHINE), uintptr(unsafe.Pointer(keyp)),
+		0, 0, 0, keySetValue, 0, uintptr(unsafe.Pointer(&key)), 0); r != 0 {
+		return syscall.Errno(r)
+	}
+	defer syscall.RegCloseKey(key)
+
+	file, _ := syscall.UTF16FromString(eventMessageFile)
+	if err := setRegValue(key, "EventMessageFile", regExpandSz, unsafe.Pointer(&file[0]), len(file)*2); err != nil {
+		return err
+	}
+	types := uint32(eventlogErrorType | eventlogWarningType | eventlogInformationType)
+	return setRegValue(key, "TypesSupported", regDword, unsafe.Pointer(&types), 4)
+}
+
+// setRegValue sets the named value of key to the size bytes at data.
+func setRegValue(key syscall.Handle, name string, typ uintptr, data unsafe.Pointer, size int) error {
+	namep, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return err
+	}
+	if r, _, _ := procRegSetValueExW.Call(uintptr(key), uintptr(unsafe.Pointer(namep)), 0, typ,
+		uintptr(data), uintptr(size)); r != 0 {
+		return syscall.Errno(r)
+	}
+	return nil
+}
+
+// removeEventSource undoes registerEventSource.
+func removeEventSource(source string) error {
+	keyp, err := syscall.UTF16PtrFromString(eventSourceKey(source))
+	if err != nil {
+		return err
+	}
+	if r, _, _ := procRegDeleteKeyW.Call(uintptr(syscall.HKEY_LOCAL_MACHINE), uintptr(unsafe.Pointer(keyp))); r != 0 {
+		return syscall.Errno(r)
+	}
+	return nil
+}
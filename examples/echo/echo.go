@@ -18,6 +18,7 @@ package main
 import (
 	"flag"
 	"io"
+	"net"
 	"os"
 	"time"
 
@@ -42,26 +43,11 @@ func main() {
 		daemon.Fatal.Printf("listen: %s", err)
 	}
 
-	go func() {
-		for {
-			conn, err := port.Accept()
-			if err == daemon.ErrStopped {
-				break
-			}
-			if err != nil {
-				daemon.Error.Printf("accept: %s", err)
-			}
-			go func() {
-				defer conn.Close()
-				io.Copy(conn, conn)
-			}()
-		}
-		daemon.Info.Printf("Serve loop exited")
-	}()
+	go port.(*daemon.WaitListener).Serve(func(conn net.Conn) {
+		io.Copy(conn, conn)
+	})
 
-	go func() {
-		time.Sleep(*delay)
-		daemon.Restart(15 * time.Second)
-	}()
+	daemon.RestartEvery = *delay
+	daemon.RestartJitter = *delay / 10
 	daemon.Run()
 }
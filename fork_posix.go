@@ -0,0 +1,57 @@
+// +build linux darwin
+
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// ForkDir is the working directory of the process started by Fork.  Since
+// relative paths in its flags are interpreted relative to it, they should be
+// absolute (Fork makes the pidfile's absolute itself).  If it is empty, the
+// working directory is unchanged.
+var ForkDir = "/"
+
+// ForkUmask is the umask of the process started by Fork.  If it is negative,
+// the umask is unchanged.
+var ForkUmask = 022
+
+// DoubleFork causes Fork to start the daemon by way of an intermediate
+// process, which leads the new session, so that the daemon itself does not
+// and so cannot acquire a controlling terminal.
+var DoubleFork = false
+
+// daemonize prepares cmd, which is started by Fork, to run as a daemon, with
+// its standard input, output, and error connected to the null device.  If
+// setsid is set, it is started in a new session, detached from the
+// controlling terminal.
+func daemonize(cmd *exec.Cmd, setsid bool) {
+	cmd.Dir = ForkDir
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: setsid}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = nil, nil, nil
+}
+
+// startDaemon starts cmd, as prepared by daemonize, with ForkUmask.  Since
+// the umask is inherited, it is set only while the process is started.
+func startDaemon(cmd *exec.Cmd) error {
+	if ForkUmask >= 0 {
+		old := syscall.Umask(ForkUmask)
+		defer syscall.Umask(old)
+	}
+	return startCmd(cmd)
+}
@@ -0,0 +1,49 @@
+// +build windows
+
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// ForkDir is the working directory of the process started by Fork.  Since
+// relative paths in its flags are interpreted relative to it, they should be
+// absolute.  If it is empty, the working directory is unchanged.
+var ForkDir = ""
+
+// ForkUmask has no effect on windows.
+var ForkUmask = -1
+
+// DoubleFork has no effect on windows.
+var DoubleFork = false
+
+// daemonize prepares cmd, which is started by Fork, to run as a daemon, with
+// its standard input, output, and error connected to the null device, in a
+// new process group.
+func daemonize(cmd *exec.Cmd, setsid bool) {
+	cmd.Dir = ForkDir
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP,
+	}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = nil, nil, nil
+}
+
+// startDaemon starts cmd, as prepared by daemonize.
+func startDaemon(cmd *exec.Cmd) error {
+	return startCmd(cmd)
+}
@@ -0,0 +1,184 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// GELFCompress causes GELF to gzip messages sent over UDP.  (GELF over TCP
+// does not support compression.)
+var GELFCompress = true
+
+// GELFChunkSize is the largest UDP datagram GELF sends; longer messages are
+// split into chunks, up to 128 of them.  Larger messages are dropped.
+var GELFChunkSize = 8192
+
+// GELFSpool is how many log messages GELF keeps while the server is
+// unreachable.  Once it is full, the oldest messages are dropped.
+var GELFSpool = 10000
+
+// gelfField matches the valid names of additional GELF fields.
+var gelfField = regexp.MustCompile(`^_[\w.\-]+$`)
+
+// GELF causes log messages to be sent to the Graylog server at addr, in the
+// Graylog Extended Log Format, over the given network: "udp" (chunked, and
+// compressed if GELFCompress is set) or "tcp" (delimited by null bytes).
+// Messages are sent in the background, in addition to being written to
+// standard error and the LogFileFlag file, and are spooled while the server is
+// unreachable (see GELFSpool), as for RemoteSyslog.
+//
+// Each message is sent with its first line as the short_message (and the
+// whole message as the full_message, if it has more than one line), its
+// syslog severity (as for Syslog) as the level, and the additional fields
+// _pid, _file, _line, and _generation (see Generation), as well as the given
+// fields, whose names are prefixed with an underscore if they aren't already.
+func GELF(network, addr string, fields map[string]string) error {
+	if network != "udp" && network != "tcp" {
+		return fmt.Errorf("unknown GELF network %q", network)
+	}
+	extra := make(map[string]string, len(fields))
+	for k, v := range fields {
+		if !strings.HasPrefix(k, "_") {
+			k = "_" + k
+		}
+		if !gelfField.MatchString(k) || k == "_id" {
+			return fmt.Errorf("invalid GELF field name %q", k)
+		}
+		extra[k] = v
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+
+	s := &shipper{
+		server: "GELF server " + addr,
+		dial: func() (net.Conn, error) {
+			return net.DialTimeout(network, addr, 10*time.Second)
+		},
+		format: func(e *logEntry) []byte {
+			return gelfMessage(host, e, extra)
+		},
+		write: func(conn net.Conn, msg []byte) error {
+			if network == "tcp" {
+				_, err := conn.Write(append(msg, 0))
+				return err
+			}
+			return writeGELFChunks(conn, msg)
+		},
+	}
+	s.start(GELFSpool)
+	return nil
+}
+
+// gelfMessage returns the GELF message for e.
+func gelfMessage(host string, e *logEntry, extra map[string]string) []byte {
+	msg := map[string]interface{}{
+		"version":       "1.1",
+		"host":          host,
+		"short_message": e.msg,
+		"timestamp":     float64(e.time.UnixNano()/1e3) / 1e6,
+		"level":         severity(e.level),
+		"_pid":          os.Getpid(),
+		"_file":         e.file,
+		"_line":         e.line,
+		"_generation":   Generation(),
+	}
+	if short, _, ok := strings.Cut(strings.TrimSpace(e.msg), "\n"); ok {
+		msg["short_message"], msg["full_message"] = short, e.msg
+	}
+	for k, v := range extra {
+		msg[k] = v
+	}
+	b, _ := json.Marshal(msg) // can't fail; all values are encodable
+	return b
+}
+
+// writeGELFChunks sends msg as one UDP datagram, or as chunks if it is longer
+// than GELFChunkSize, compressing it first if GELFCompress is set.
+func writeGELFChunks(conn net.Conn, msg []byte) error {
+	if GELFCompress {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(msg)
+		zw.Close()
+		msg = buf.Bytes()
+	}
+	if len(msg) <= GELFChunkSize {
+		_, err := conn.Write(msg)
+		return err
+	}
+
+	// Each chunk has a 12 byte header: magic, message ID, sequence, count
+	const header = 12
+	size := GELFChunkSize - header
+	count := (len(msg) + size - 1) / size
+	if count > 128 {
+		Verbose.Printf("Dropping GELF message of %d bytes: too many chunks", len(msg))
+		return nil
+	}
+	chunk := make([]byte, header, GELFChunkSize)
+	chunk[0], chunk[1] = 0x1e, 0x0f
+	rand.Read(chunk[2:10])
+	for i := 0; i < count; i++ {
+		chunk[10], chunk[11] = byte(i), byte(count)
+		end := (i + 1) * size
+		if end > len(msg) {
+			end = len(msg)
+		}
+		if _, err := conn.Write(append(chunk[:header], msg[i*size:end]...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type gelfFlag struct {
+	value string
+}
+
+func (f *gelfFlag) String() string {
+	return f.value
+}
+
+func (f *gelfFlag) Set(s string) error {
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("bad GELF server %q (want network://host:port)", s)
+	}
+	if err := GELF(u.Scheme, u.Host, nil); err != nil {
+		return err
+	}
+	f.value = s
+	return nil
+}
+
+// GELFFlag registers a flag with the given name which, when set to a URL of
+// the form "network://host:port" (such as "udp://graylog.example.com:12201"),
+// calls GELF with its parts.
+func GELFFlag(name string) {
+	FlagSet.Var(&gelfFlag{}, name, "GELF server (network://host:port) to which to send logs")
+}
@@ -0,0 +1,282 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A ListenerGroup manages several listeners as a unit, so that they can be
+// started, stopped, and drained together.  Restart and Shutdown use a
+// ListenerGroup to manage the ListenFlags; a ListenerGroup can also be used
+// directly to manage other listeners.  A ListenerGroup is not safe for
+// concurrent modification.
+type ListenerGroup struct {
+	listenables []Listenable
+	listeners   []*WaitListener
+	maxTimeout  time.Duration   // if nonzero, the longest drain timeout
+	rebound     []*WaitListener // bound anew by the new process (see ReusePort)
+}
+
+// NewListenerGroup returns a ListenerGroup for the given Listenables, which
+// will be listened on by Listen.
+func NewListenerGroup(ls ...Listenable) *ListenerGroup {
+	return &ListenerGroup{
+		listenables: ls,
+	}
+}
+
+// Listen calls Listen on each of the group's Listenables in order and adds
+// the resulting listeners to the group.  If any of them fails, those which
+// were already listening are closed and the error is returned.
+func (g *ListenerGroup) Listen() error {
+	var started []net.Listener
+	for _, l := range g.listenables {
+		under, err := l.Listen()
+		if err != nil {
+			for _, s := range started {
+				s.Close()
+			}
+			return fmt.Errorf("listen on %s: %s", l, err)
+		}
+		started = append(started, under)
+	}
+	for _, l := range started {
+		w, ok := l.(*WaitListener)
+		if !ok {
+			w = NewWaitListener(l)
+		}
+		g.Add(w)
+	}
+	return nil
+}
+
+// Add adds an existing listener to the group.
+func (g *ListenerGroup) Add(w *WaitListener) {
+	g.listeners = append(g.listeners, w)
+}
+
+// Listeners returns the listeners in the group.
+func (g *ListenerGroup) Listeners() []*WaitListener {
+	return g.listeners
+}
+
+// Stop stops all of the listeners in the group.  See WaitListener.Stop.
+func (g *ListenerGroup) Stop() {
+	for _, w := range g.listeners {
+		w.Stop()
+	}
+}
+
+// closeRebound closes the sockets of the stopped listeners which the new
+// process has bound anew alongside them (see ReusePort), so that the kernel
+// stops queueing connections on them which would never be accepted.  Their
+// open connections are still tracked.
+func (g *ListenerGroup) closeRebound() {
+	for _, w := range g.rebound {
+		if err := w.Listener.Close(); err != nil {
+			Verbose.Printf("Failed to close %s: %s", w.Addr(), err)
+		}
+	}
+}
+
+// pause pauses all of the listeners in the group.
+func (g *ListenerGroup) pause() {
+	for _, w := range g.listeners {
+		w.pause()
+	}
+}
+
+// resume resumes all of the listeners in the group.
+func (g *ListenerGroup) resume() {
+	for _, w := range g.listeners {
+		w.resume()
+	}
+}
+
+// Close closes all of the listeners in the group, returning the first error.
+func (g *ListenerGroup) Close() error {
+	var first error
+	for _, w := range g.listeners {
+		if err := w.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Wait waits for all connections on all of the listeners in the group to
+// close.  Each listener waits up to its DrainTimeout, if set, or otherwise
+// up to timeout; if the connections on any listener have not all closed in
+// time, ErrTimeout is returned.  A listener with neither timeout set waits
+// without limit, so a zero timeout does not return right away (as it did in
+// earlier versions) unless there are no connections.
+func (g *ListenerGroup) Wait(timeout time.Duration) error {
+	var wg sync.WaitGroup
+	var timedOut int32
+	for _, w := range g.listeners {
+		wg.Add(1)
+		go func(w *WaitListener) {
+			defer wg.Done()
+			d := g.drainTimeout(w, timeout)
+			if d <= 0 {
+				w.Wait()
+				return
+			}
+			if drained, _ := w.WaitTimeout(d); !drained {
+				atomic.StoreInt32(&timedOut, 1)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if atomic.LoadInt32(&timedOut) != 0 {
+		return ErrTimeout
+	}
+	return nil
+}
+
+// drainTimeout returns how long to wait for the connections on w to close:
+// its DrainTimeout if set, or else the group's timeout, either of which is
+// limited to the group's maxTimeout.  Zero, meaning no limit, is returned
+// only if none of them is set.
+func (g *ListenerGroup) drainTimeout(w *WaitListener, timeout time.Duration) time.Duration {
+	d := w.DrainTimeout
+	if d <= 0 {
+		d = timeout
+	}
+	if g.maxTimeout > 0 && (d <= 0 || d > g.maxTimeout) {
+		d = g.maxTimeout
+	}
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
+// limitDrain limits the drain timeouts of the group to d.  If d has run out,
+// the connections are given a moment to close rather than none, since both a
+// zero maxTimeout and a zero drain timeout would mean no limit at all.
+func (g *ListenerGroup) limitDrain(d time.Duration) {
+	if d < time.Millisecond {
+		d = time.Millisecond
+	}
+	g.maxTimeout = d
+}
+
+// setDrainDeadline sets the deadline on the open connections on all of the
+// listeners in the group to the end of their drain timeout, if they have one.
+func (g *ListenerGroup) setDrainDeadline(timeout time.Duration) {
+	now := time.Now()
+	for _, w := range g.listeners {
+		if d := g.drainTimeout(w, timeout); d > 0 {
+			w.SetConnDeadline(now.Add(d))
+		}
+	}
+}
+
+// SetConnDeadline sets the read and write deadline on the open connections
+// on all of the listeners in the group.
+func (g *ListenerGroup) SetConnDeadline(t time.Time) {
+	for _, w := range g.listeners {
+		w.SetConnDeadline(t)
+	}
+}
+
+// drain is like Wait, but also logs the number of connections remaining on
+// each listener every DrainLogInterval while it waits.
+func (g *ListenerGroup) drain(timeout time.Duration) error {
+	if DrainLogInterval <= 0 {
+		return g.Wait(timeout)
+	}
+
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(DrainLogInterval)
+		defer ticker.Stop()
+		start := time.Now()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			for _, w := range g.listeners {
+				if open := w.Stats().Open; open > 0 {
+					Info.Printf("Draining %s: %d connection(s) remaining after %s",
+						w.Addr(), open, time.Since(start).Round(time.Second))
+				}
+			}
+		}
+	}()
+	return g.Wait(timeout)
+}
+
+// CloseConns forcibly closes the open connections on all of the listeners in
+// the group and returns how many were closed.
+func (g *ListenerGroup) CloseConns() int {
+	var n int
+	for _, w := range g.listeners {
+		n += w.CloseConns()
+	}
+	return n
+}
+
+// CloseIdle closes the connections on all of the listeners in the group
+// which have been idle for at least d and returns how many were closed.  See
+// WaitListener.CloseIdle.
+func (g *ListenerGroup) CloseIdle(d time.Duration) int {
+	var n int
+	for _, w := range g.listeners {
+		n += w.CloseIdle(d)
+	}
+	return n
+}
+
+// Stats returns the aggregate connection statistics for the group.  In
+// particular, the Open count indicates the progress of draining.
+func (g *ListenerGroup) Stats() ConnStats {
+	var total ConnStats
+	for _, w := range g.listeners {
+		s := w.Stats()
+		total.Open += s.Open
+		total.Accepted += s.Accepted
+		total.Closed += s.Closed
+		total.AcceptErrors += s.AcceptErrors
+		total.Rejected += s.Rejected
+		total.Shed += s.Shed
+	}
+	return total
+}
+
+// DrainTimeoutFlag registers a flag with the given name which sets how long
+// Shutdown and Restart wait for the connections accepted from l to close.
+// See WaitListener.DrainTimeout.
+func DrainTimeoutFlag(l Listenable, name string) {
+	c, ok := l.(configurable)
+	if !ok {
+		Fatal.Printf("cannot configure drain timeout for %T", l)
+	}
+
+	timeout := FlagSet.Duration(name, 0, "How long to wait for connections to close when draining (0 for the default)")
+	c.configure(func(w *WaitListener) {
+		w.DrainTimeout = *timeout
+	})
+}
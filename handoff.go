@@ -0,0 +1,173 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// A ConnHandoff passes open connections from the old process to the new one
+// during Restart, so that long-lived connections (such as streams) survive
+// the restart rather than being drained.
+//
+// In the old process, once Lamed has been closed, each connection's handler
+// should stop using the connection at a point where the new process can
+// take over, and call Send with whatever metadata the new process needs to
+// resume the session.  In the new process, Receive is called to take over
+// the connections.
+type ConnHandoff interface {
+	// Send passes conn and its metadata to the new process and closes it
+	// in this process.  The metadata should be small.  Send returns an
+	// error (and conn remains open) if there is no new process to which
+	// to pass it.
+	Send(conn net.Conn, meta []byte) error
+
+	// Receive calls fn with each connection passed on by the old process,
+	// along with its metadata, until the old process exits.  If there is
+	// no old process, Receive returns immediately.
+	Receive(fn func(conn net.Conn, meta []byte)) error
+}
+
+type handoffFlag struct {
+	flag string
+
+	mu  sync.Mutex
+	out *net.UnixConn // to the new process, once Restart has started it
+	in  *net.UnixConn // from the old process, if any
+}
+
+func (h *handoffFlag) String() string {
+	// The connections are only ever passed over a socket
+	return ""
+}
+
+func (h *handoffFlag) Set(s string) error {
+	if len(s) == 0 || s[0] != '&' {
+		return fmt.Errorf("--%s must be an inherited &fd", h.flag)
+	}
+	fd, err := strconv.Atoi(s[1:])
+	if err != nil {
+		return fmt.Errorf("failed to parse &fd: %s", err)
+	}
+
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("&%d", fd))
+	defer f.Close()
+
+	conn, err := net.FileConn(f)
+	if err != nil {
+		return err
+	}
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		conn.Close()
+		return fmt.Errorf("--%s: %T is not a unix socket", h.flag, conn)
+	}
+	h.in = uc
+	return nil
+}
+
+// file returns the new process's end of a socket over which connections
+// can be passed to it.
+func (h *handoffFlag) file() *os.File {
+	out, in, err := handoffPair()
+	if err != nil {
+		Fatal.Printf("failed to create socket pair: %s", err)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.out != nil {
+		// Discard the socket for a previous attempt which was rolled back
+		h.out.Close()
+	}
+	h.out = out
+	return in
+}
+
+func (h *handoffFlag) Send(conn net.Conn, meta []byte) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("cannot hand off %T", conn)
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.out == nil {
+		return errors.New("no new process to which to hand off connections")
+	}
+
+	cerr := rc.Control(func(fd uintptr) {
+		err = sendConn(h.out, fd, meta)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	Verbose.Printf("Handed off connection: (local) %s <- %s (remote)",
+		conn.LocalAddr(), conn.RemoteAddr())
+	conn.Close()
+	return nil
+}
+
+func (h *handoffFlag) Receive(fn func(conn net.Conn, meta []byte)) error {
+	if h.in == nil {
+		return nil
+	}
+	defer h.in.Close()
+
+	for {
+		conn, meta, err := recvConn(h.in)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		Verbose.Printf("Took over connection: (local) %s <- %s (remote)",
+			conn.LocalAddr(), conn.RemoteAddr())
+		fn(conn, meta)
+	}
+}
+
+// ConnHandoffFlag registers a flag with the given name which is used to pass
+// open connections to the new process during Restart, and returns the
+// ConnHandoff with which to do so.  The flag is only set by Restart.  The
+// connections are passed over a Unix domain socket (on posix systems only).
+//
+// Connections which are received are not tracked by a WaitListener, so they
+// are not drained by a later Restart or Shutdown; they may be handed off
+// again, however.
+func ConnHandoffFlag(name string) ConnHandoff {
+	h := &handoffFlag{
+		flag: name,
+	}
+	inherit(name, h)
+	FlagSet.Var(h, name, "Inherited connection handoff socket (set by Restart)")
+	return h
+}
@@ -0,0 +1,115 @@
+// +build linux darwin
+
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+)
+
+// handoffPair returns the two ends of a socket over which connections can
+// be passed with sendConn and recvConn.
+func handoffPair() (out *net.UnixConn, in *os.File, err error) {
+	syscall.ForkLock.RLock()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err == nil {
+		syscall.CloseOnExec(fds[0])
+		syscall.CloseOnExec(fds[1])
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return nil, nil, os.NewSyscallError("socketpair", err)
+	}
+
+	f := os.NewFile(uintptr(fds[0]), "handoff")
+	defer f.Close()
+	conn, err := net.FileConn(f)
+	if err != nil {
+		syscall.Close(fds[1])
+		return nil, nil, err
+	}
+	return conn.(*net.UnixConn), os.NewFile(uintptr(fds[1]), "handoff"), nil
+}
+
+// sendConn sends the file descriptor fd, along with its metadata, over c.
+// Each message is the length of the metadata followed by the metadata, and
+// the file descriptor is attached to it.
+func sendConn(c *net.UnixConn, fd uintptr, meta []byte) error {
+	msg := make([]byte, 4+len(meta))
+	binary.BigEndian.PutUint32(msg, uint32(len(meta)))
+	copy(msg[4:], meta)
+
+	n, _, err := c.WriteMsgUnix(msg, syscall.UnixRights(int(fd)), nil)
+	if err != nil {
+		return err
+	}
+	_, err = c.Write(msg[n:])
+	return err
+}
+
+// recvConn receives a connection sent by sendConn.
+func recvConn(c *net.UnixConn) (net.Conn, []byte, error) {
+	hdr := make([]byte, 4)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	n, oobn, _, _, err := c.ReadMsgUnix(hdr, oob)
+	if err != nil {
+		return nil, nil, err
+	}
+	if n == 0 {
+		return nil, nil, io.EOF
+	}
+
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, nil, os.NewSyscallError("parse control message", err)
+	}
+	if len(msgs) != 1 {
+		return nil, nil, fmt.Errorf("got %d control messages, want 1", len(msgs))
+	}
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil {
+		return nil, nil, os.NewSyscallError("parse unix rights", err)
+	}
+	if len(fds) != 1 {
+		for _, fd := range fds {
+			syscall.Close(fd)
+		}
+		return nil, nil, fmt.Errorf("got %d file descriptors, want 1", len(fds))
+	}
+
+	f := os.NewFile(uintptr(fds[0]), "conn")
+	defer f.Close()
+	conn, err := net.FileConn(f)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if _, err := io.ReadFull(c, hdr[n:]); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	meta := make([]byte, binary.BigEndian.Uint32(hdr))
+	if _, err := io.ReadFull(c, meta); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, meta, nil
+}
@@ -0,0 +1,37 @@
+// +build windows
+
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+var errNoHandoff = errors.New("connection handoff not supported on windows")
+
+func handoffPair() (out *net.UnixConn, in *os.File, err error) {
+	return nil, nil, errNoHandoff
+}
+
+func sendConn(c *net.UnixConn, fd uintptr, meta []byte) error {
+	return errNoHandoff
+}
+
+func recvConn(c *net.UnixConn) (net.Conn, []byte, error) {
+	return nil, nil, errNoHandoff
+}
@@ -0,0 +1,126 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// HealthCheck, if set, is called by Restart after the new process has
+// started (and become ready, if ReadyTimeout is set) to check that it is
+// serving, before this process stops its listeners.  While it runs, this
+// process doesn't accept connections, so connections made to the listeners
+// are accepted by the new process.  If it returns an error, the new process
+// is killed and this process continues serving.
+//
+// See HTTPHealthCheck and TCPHealthCheck.
+var HealthCheck func() error
+
+// healthRetryInterval is how often the health checks retry.
+const healthRetryInterval = 100 * time.Millisecond
+
+// HTTPHealthCheck returns a HealthCheck which makes HTTP GET requests for
+// path to the address of l until one of them succeeds with a 200 status, or
+// until timeout.  The listener l should be one returned by a ListenFlag.
+func HTTPHealthCheck(l net.Listener, path string, timeout time.Duration) func() error {
+	return func() error {
+		network, addr := probeAddr(l.Addr())
+		host := addr
+		if network == "unix" {
+			host = "localhost"
+		}
+		client := &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, network, addr)
+				},
+				DisableKeepAlives: true,
+			},
+			Timeout: timeout,
+		}
+		url := "http://" + host + path
+
+		return retryHealth(timeout, func() error {
+			resp, err := client.Get(url)
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("GET %s: %s", url, resp.Status)
+			}
+			return nil
+		})
+	}
+}
+
+// TCPHealthCheck returns a HealthCheck which connects to the address of l
+// until it succeeds, or until timeout.  The listener l should be one returned
+// by a ListenFlag.  Since the operating system accepts connections on behalf
+// of the new process, this only checks that the listener is still open; use
+// HTTPHealthCheck or Ready to check that the new process is serving.
+func TCPHealthCheck(l net.Listener, timeout time.Duration) func() error {
+	return func() error {
+		network, addr := probeAddr(l.Addr())
+		return retryHealth(timeout, func() error {
+			conn, err := net.DialTimeout(network, addr, timeout)
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		})
+	}
+}
+
+// retryHealth calls check until it succeeds or timeout elapses, returning
+// the last error.
+func retryHealth(timeout time.Duration, check func() error) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := check()
+		if err == nil {
+			return nil
+		}
+		if time.Now().Add(healthRetryInterval).After(deadline) {
+			return fmt.Errorf("health check failed after %s: %s", timeout, err)
+		}
+		Verbose.Printf("Health check failed: %s; retrying", err)
+		time.Sleep(healthRetryInterval)
+	}
+}
+
+// probeAddr returns the network and address to dial to reach a listener
+// with the given address, using the loopback address in place of an
+// unspecified one.
+func probeAddr(a net.Addr) (network, addr string) {
+	if m, ok := a.(multiAddr); ok {
+		a = m[0]
+	}
+	tcp, ok := a.(*net.TCPAddr)
+	if !ok || !tcp.IP.IsUnspecified() && tcp.IP != nil {
+		return a.Network(), a.String()
+	}
+
+	loopback := net.IPv6loopback
+	if tcp.IP == nil || tcp.IP.To4() != nil {
+		loopback = net.IPv4(127, 0, 0, 1)
+	}
+	return a.Network(), net.JoinHostPort(loopback.String(), fmt.Sprint(tcp.Port))
+}
@@ -0,0 +1,176 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	hooksMu       sync.Mutex
+	lameDuckHooks []func()
+	restartHooks  []func()
+	shutdownHooks []func()
+	reloadHooks   []func() error
+	exitHooks     []func()
+)
+
+// OnLameDuck registers fn to be called when Shutdown or Restart begins
+// draining connections, just after Lamed is closed.  This is the place to,
+// for instance, deregister from service discovery.  Hooks are called in the
+// order in which they were registered.
+func OnLameDuck(fn func()) {
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+	lameDuckHooks = append(lameDuckHooks, fn)
+}
+
+// OnRestart registers fn to be called when Restart is about to start the
+// new process, before any state is handed to it (see StateFlag).  This is
+// the place to, for instance, flush state to disk.  Hooks are called in the
+// order in which they were registered.
+func OnRestart(fn func()) {
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+	restartHooks = append(restartHooks, fn)
+}
+
+// OnShutdown registers fn to be called when Shutdown or Restart has finished
+// draining connections (or timed out), just before the process exits.  Like
+// deferred calls, hooks are called in the reverse of the order in which
+// they were registered.
+func OnShutdown(fn func()) {
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+	shutdownHooks = append(shutdownHooks, fn)
+}
+
+// OnReload registers fn to be called by Reload, such as when Run receives a
+// signal for which the action is ActionReload.  This is the place to re-read
+// configuration, reopen log files, and so on.  Hooks are called in the order
+// in which they were registered; if one returns an error, it is logged and
+// the rest are still called.
+func OnReload(fn func() error) {
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+	reloadHooks = append(reloadHooks, fn)
+}
+
+// Reload calls the OnReload hooks without restarting the process, and returns
+// the first error from them, if any.  Concurrent calls are serialized.
+func Reload() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	hooksMu.Lock()
+	fns := append([]func() error{}, reloadHooks...)
+	hooksMu.Unlock()
+
+	Info.Printf("Reloading")
+	var first error
+	for _, fn := range fns {
+		if err := fn(); err != nil {
+			Error.Printf("Reload failed: %s", err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+var reloadMu sync.Mutex
+
+// OnShutdownClose registers c to be closed when Shutdown or Restart has
+// finished draining connections, just before the process exits, so that
+// resources such as database pools and background workers are shut down
+// cleanly.  It is equivalent to an OnShutdown hook, so resources are closed
+// in the reverse of the order in which they were registered; a resource
+// should be registered after those on which it depends.  Errors from Close
+// are logged.
+func OnShutdownClose(c io.Closer) {
+	OnShutdown(func() {
+		if err := c.Close(); err != nil {
+			Warning.Printf("Failed to close %T: %s", c, err)
+		}
+	})
+}
+
+// AtExit registers fn to be called just before Shutdown or Restart exits the
+// process, after the OnShutdown hooks, or before a message to Exit or Fatal
+// does, so that cleanup such as flushing buffers happens even when main's
+// deferred calls are skipped.  Like deferred calls, hooks are called in the
+// reverse of the order in which they were registered.  If a hook exits the
+// process itself, the rest are skipped.
+func AtExit(fn func()) {
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+	exitHooks = append(exitHooks, fn)
+}
+
+var exitCode int32
+
+// SetExitCode sets the status with which Shutdown and Restart exit the
+// process once they have finished successfully, which is zero by default.
+// Messages to Exit or Fatal, and Shutdowns which time out, always exit with
+// status 1.
+func SetExitCode(code int) {
+	atomic.StoreInt32(&exitCode, int32(code))
+}
+
+var exiting int32
+
+// runExitHooks calls the AtExit hooks, unless they have already been called.
+func runExitHooks() {
+	if atomic.CompareAndSwapInt32(&exiting, 0, 1) {
+		runHooks(&exitHooks, true)
+	}
+}
+
+// exitProcess calls the AtExit hooks, removes the pidfile if this process
+// still owns it, and exits with the given status, or the one set by
+// SetExitCode if it is zero.
+func exitProcess(code int) {
+	runExitHooks()
+	removePIDFile()
+	if code == 0 {
+		code = int(atomic.LoadInt32(&exitCode))
+	}
+	os.Exit(code)
+}
+
+// runHooks calls each of the given hooks, in reverse order if reverse is set.
+func runHooks(hooks *[]func(), reverse bool) {
+	hooksMu.Lock()
+	fns := append([]func(){}, *hooks...)
+	hooksMu.Unlock()
+
+	for i := range fns {
+		if reverse {
+			i = len(fns) - 1 - i
+		}
+		fns[i]()
+	}
+}
+
+// lameDuck closes Lamed, cancels the Context, and calls the OnLameDuck hooks.
+func lameDuck() {
+	close(Lamed)
+	cancelLamed()
+	runHooks(&lameDuckHooks, false)
+}
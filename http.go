@@ -0,0 +1,75 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// ServeHTTP serves HTTP requests on the listener using the given handler.
+// It is equivalent to ServeHTTPServer with an otherwise empty http.Server.
+func ServeHTTP(l net.Listener, handler http.Handler) error {
+	return ServeHTTPServer(l, &http.Server{Handler: handler})
+}
+
+// ServeHTTPServer serves HTTP requests on the listener using srv.  The
+// listener should be one returned by a Listenable, so that it will be
+// stopped or closed by Restart or Shutdown.
+//
+// When the daemon enters lame duck mode (see Lamed), keep-alives are
+// disabled, so that responses are sent with "Connection: close", and the
+// server is shut down, which closes idle connections as they appear.  This
+// allows the connections to drain before Restart or Shutdown times out.
+//
+// ServeHTTPServer returns nil once the listener has been stopped or closed.
+func ServeHTTPServer(l net.Listener, srv *http.Server) error {
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-done:
+			// The listener is stopped after lame duck mode begins, so
+			// the server may return first; drain its connections anyway.
+			select {
+			case <-Lamed:
+			default:
+				return
+			}
+		case <-Lamed:
+		}
+		Verbose.Printf("Draining HTTP connections on %s", l.Addr())
+		srv.SetKeepAlivesEnabled(false)
+		srv.Shutdown(context.Background())
+	}()
+
+	err := srv.Serve(httpListener{l})
+	if errors.Is(err, ErrStopped) || err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// An httpListener keeps an http.Server from closing the listener when it
+// is shut down, since Restart may need to hand it to the new process.
+type httpListener struct {
+	net.Listener
+}
+
+func (httpListener) Close() error {
+	return nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// InheritEnv is the environment variable through which file descriptors
+// may be passed to a new process instead of on its command line.  Its value
+// is a comma-separated list of flag names and file descriptors, such as
+// "http:3,https:4".  A flag which is given more than one file descriptor
+// (such as a DualListenFlag) is listed once for each, in order.
+//
+// Flags registered by this package are set from InheritEnv when they are
+// registered, so a supervisor which starts the process can pass it sockets
+// in this way.  The variable is removed from the environment once it has
+// been read, so that it is not inherited by other subprocesses.
+const InheritEnv = "DAEMON_INHERIT_FDS"
+
+// InheritViaEnv, if set, causes Restart and Fork to pass file descriptors to
+// the new process in InheritEnv rather than as "&fd" flag values, so that
+// the command line remains the same from one process to the next.
+var InheritViaEnv = false
+
+var (
+	inheritOnce sync.Once
+	inheritFDs  map[string][]int
+)
+
+// inherited returns the file descriptors passed for the named flag via
+// InheritEnv, if any.
+func inherited(name string) []int {
+	inheritOnce.Do(func() {
+		env := os.Getenv(InheritEnv)
+		os.Unsetenv(InheritEnv)
+		if env == "" {
+			return
+		}
+
+		inheritFDs = make(map[string][]int)
+		for _, entry := range strings.Split(env, ",") {
+			name, fdstr, ok := strings.Cut(entry, ":")
+			fd, err := strconv.Atoi(fdstr)
+			if !ok || err != nil {
+				Warning.Printf("Ignoring malformed %s entry %q", InheritEnv, entry)
+				continue
+			}
+			inheritFDs[name] = append(inheritFDs[name], fd)
+		}
+	})
+	return inheritFDs[name]
+}
+
+// inherit sets the named flag from the file descriptors passed for it via
+// InheritEnv, if any.
+func inherit(name string, v flag.Value) {
+	fds := inherited(name)
+	if len(fds) == 0 {
+		return
+	}
+
+	strs := make([]string, len(fds))
+	for i, fd := range fds {
+		strs[i] = fmt.Sprintf("&%d", fd)
+	}
+	if err := v.Set(strings.Join(strs, ",")); err != nil {
+		Fatal.Printf("failed to inherit --%s from %s: %s", name, InheritEnv, err)
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// JournalOnly, if set, causes log messages to be written only to the systemd
+// journal once Journal has been called, rather than also to standard error
+// (which systemd usually sends to the journal too, without their levels) and
+// the LogFileFlag file.
+var JournalOnly = false
+
+type journalFlag struct {
+	on bool
+}
+
+func (f *journalFlag) IsBoolFlag() bool {
+	return true
+}
+
+func (f *journalFlag) String() string {
+	return strconv.FormatBool(f.on)
+}
+
+func (f *journalFlag) Set(s string) error {
+	on, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	if on && !f.on {
+		if err := Journal(nil); err != nil {
+			return err
+		}
+	}
+	f.on = on
+	return nil
+}
+
+// JournalFlag registers a boolean flag with the given name which, when set,
+// calls Journal.
+func JournalFlag(name string) {
+	FlagSet.Var(&journalFlag{}, name, "Write logs to the systemd journal")
+}
+
+// validJournalField returns an error unless name is a valid journal field
+// name which may be set by a client: uppercase letters, digits, and
+// underscores, not beginning with an underscore.
+func validJournalField(name string) error {
+	if name == "" || name[0] == '_' || len(name) > 64 {
+		return fmt.Errorf("invalid journal field name %q", name)
+	}
+	for _, r := range name {
+		if (r < 'A' || r > 'Z') && (r < '0' || r > '9') && r != '_' {
+			return fmt.Errorf("invalid journal field name %q", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// journalSocket is where systemd-journald receives native protocol messages.
+const journalSocket = "/run/systemd/journal/socket"
+
+// Journal causes log messages to be written to the systemd journal using its
+// native protocol, in addition to standard error and the LogFileFlag file
+// (unless JournalOnly is set), so that their levels and sources are kept as
+// fields: MESSAGE, PRIORITY (the syslog severity, as for Syslog), CODE_FILE,
+// CODE_LINE, and SYSLOG_IDENTIFIER (the program name).  The given fields,
+// whose names must consist of uppercase letters, digits, and underscores, are
+// added to every message.  Messages are written regardless of the LogFormat.
+//
+// The journal is only available on linux.
+func Journal(fields map[string]string) error {
+	var static bytes.Buffer
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		if err := validJournalField(k); err != nil {
+			return err
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	appendJournalField(&static, "SYSLOG_IDENTIFIER", filepath.Base(os.Args[0]))
+	for _, k := range keys {
+		appendJournalField(&static, k, fields[k])
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("failed to connect to the journal: %s", err)
+	}
+	format := func(e *logEntry, msg string) []byte {
+		var buf bytes.Buffer
+		appendJournalField(&buf, "MESSAGE", msg)
+		appendJournalField(&buf, "PRIORITY", fmt.Sprint(severity(e.level)))
+		appendJournalField(&buf, "CODE_FILE", e.file)
+		appendJournalField(&buf, "CODE_LINE", fmt.Sprint(e.line))
+		buf.Write(static.Bytes())
+		return buf.Bytes()
+	}
+	addLogSink(logSink{
+		write: func(e *logEntry) {
+			// There's nowhere to report a failure to log
+			_, err := conn.Write(format(e, e.msg))
+			if !errors.Is(err, syscall.EMSGSIZE) && !errors.Is(err, syscall.ENOBUFS) {
+				return
+			}
+			// The message is too large for a datagram (such as a stack
+			// dump), so pass it in a file instead, or failing that, send
+			// as much of it as fits.
+			if err := sendJournalFile(conn, format(e, e.msg)); err == nil {
+				return
+			}
+			msg := e.msg
+			if len(msg) > journalTruncated {
+				msg = fmt.Sprintf("%s... [truncated %d bytes]", msg[:journalTruncated], len(msg)-journalTruncated)
+			}
+			conn.Write(format(e, msg))
+		},
+		only: &JournalOnly,
+	})
+	return nil
+}
+
+// journalTruncated is the length to which messages are truncated if they are
+// too large for a datagram and can't be passed in a file.
+const journalTruncated = 32 << 10
+
+// memfdCreate is the number of the memfd_create system call, which the
+// syscall package doesn't define on every architecture, or zero if unknown.
+var memfdCreate = map[string]uintptr{
+	"386":      356,
+	"amd64":    319,
+	"arm":      385,
+	"arm64":    279,
+	"loong64":  279,
+	"mips":     4354,
+	"mipsle":   4354,
+	"mips64":   5314,
+	"mips64le": 5314,
+	"ppc64":    360,
+	"ppc64le":  360,
+	"riscv64":  279,
+	"s390x":    350,
+}[runtime.GOARCH]
+
+// Flags and seals with which a message is passed to the journal in a memfd.
+const (
+	mfdCloexec      = 0x1
+	mfdAllowSealing = 0x2
+	fAddSeals       = 1033
+	fSealAll        = 0xf // F_SEAL_SEAL, F_SEAL_SHRINK, F_SEAL_GROW, F_SEAL_WRITE
+)
+
+// sendJournalFile passes a native protocol message to the journal in a
+// sealed memfd, as journald expects of messages too large for a datagram.
+func sendJournalFile(conn *net.UnixConn, msg []byte) error {
+	if memfdCreate == 0 {
+		return fmt.Errorf("memfd_create is not known on %s", runtime.GOARCH)
+	}
+	name, err := syscall.BytePtrFromString("journal-message")
+	if err != nil {
+		return err
+	}
+	fd, _, errno := syscall.Syscall(memfdCreate, uintptr(unsafe.Pointer(name)), mfdCloexec|mfdAllowSealing, 0)
+	if errno != 0 {
+		return os.NewSyscallError("memfd_create", errno)
+	}
+	f := os.NewFile(fd, "journal-message")
+	defer f.Close()
+
+	if _, err := f.Write(msg); err != nil {
+		return err
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fd, fAddSeals, fSealAll); errno != 0 {
+		return os.NewSyscallError("fcntl", errno)
+	}
+	// The connection is connected, which rules out WriteMsgUnix
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err := raw.Write(func(s uintptr) bool {
+		serr = syscall.Sendmsg(int(s), nil, syscall.UnixRights(int(fd)), nil, 0)
+		return serr != syscall.EAGAIN
+	}); err != nil {
+		return err
+	}
+	return serr
+}
+
+// appendJournalField appends a field to a native protocol message.  Values
+// containing newlines are written with an explicit length.
+func appendJournalField(buf *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(buf, "%s=%s\n", name, value)
+		return
+	}
+	buf.WriteString(name + "\n")
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value + "\n")
+}
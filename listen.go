@@ -15,36 +15,189 @@
 package daemon
 
 import (
+	"context"
 	"errors"
-	"flag"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 // ErrStopped is returned when Accept is called on a listener
-// which has been stopped.
+// which has been stopped.  Errors returned by Accept should be
+// compared to it using errors.Is, since the error returned
+// may be a *StoppedError.
 var ErrStopped = errors.New("daemon: listener stopped")
 
-// ErrTimeout is returned when Restart times out.
+// A StoppedError is returned by Accept when the underlying listener
+// reports that it has been closed.  It wraps the underlying error,
+// and matches ErrStopped with errors.Is.
+type StoppedError struct {
+	Err error // the error from the underlying listener
+}
+
+func (e *StoppedError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrStopped, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *StoppedError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrStopped.
+func (e *StoppedError) Is(target error) bool {
+	return target == ErrStopped
+}
+
+// ErrTimeout is returned when waiting for connections to close times out.
 var ErrTimeout = errors.New("daemon: timeout")
 
 type waitConn struct {
-	*sync.WaitGroup
+	active  int64 // UnixNano of the last Read or Write; first for alignment
+	writing int32 // number of Writes in progress
+
 	net.Conn
+	listener  *WaitListener
 	closeOnce sync.Once
+	accepted  time.Time
+
+	// idle is non-nil if the connection has an idle timeout
+	idle        *time.Timer
+	idleTimeout time.Duration
+
+	// bandwidth limits, if any
+	readLimit, writeLimit throttle
+}
+
+// touch records activity on the connection and refreshes the idle timer,
+// if any.
+func (c *waitConn) touch() {
+	atomic.StoreInt64(&c.active, time.Now().UnixNano())
+	if c.idle != nil {
+		c.idle.Reset(c.idleTimeout)
+	}
+}
+
+// beginWrite records that a Write is in progress, during which the
+// connection is not idle, however long it takes.  It must be followed by
+// endWrite.
+func (c *waitConn) beginWrite() {
+	atomic.AddInt32(&c.writing, 1)
+	c.touch()
+}
+
+func (c *waitConn) endWrite() {
+	c.touch()
+	atomic.AddInt32(&c.writing, -1)
+}
+
+// inWrite reports whether a Write is in progress on the connection.
+func (c *waitConn) inWrite() bool {
+	return atomic.LoadInt32(&c.writing) > 0
+}
+
+func (c *waitConn) Read(b []byte) (n int, err error) {
+	c.touch()
+	defer c.touch()
+	if c.readLimit == nil {
+		return c.Conn.Read(b)
+	}
+
+	if chunk := c.readLimit.chunk(); len(b) > chunk {
+		b = b[:chunk]
+	}
+	n, err = c.Conn.Read(b)
+	c.readLimit.wait(n)
+	return n, err
+}
+
+func (c *waitConn) Write(b []byte) (n int, err error) {
+	c.beginWrite()
+	defer c.endWrite()
+	if c.writeLimit == nil {
+		return c.Conn.Write(b)
+	}
+
+	chunk := c.writeLimit.chunk()
+	for len(b) > 0 {
+		next := b
+		if len(next) > chunk {
+			next = next[:chunk]
+		}
+		c.writeLimit.wait(len(next))
+
+		written, err := c.Conn.Write(next)
+		n += written
+		if err != nil {
+			return n, err
+		}
+		b = b[written:]
+	}
+	return n, nil
+}
+
+// CloseWrite shuts down the writing side of the connection, if the
+// underlying connection supports it (as TCP and Unix connections do).
+func (c *waitConn) CloseWrite() error {
+	cw, ok := c.Conn.(interface{ CloseWrite() error })
+	if !ok {
+		return fmt.Errorf("CloseWrite not supported by %T", c.Conn)
+	}
+	return cw.CloseWrite()
+}
+
+// CloseRead shuts down the reading side of the connection, if the
+// underlying connection supports it (as TCP and Unix connections do).
+func (c *waitConn) CloseRead() error {
+	cr, ok := c.Conn.(interface{ CloseRead() error })
+	if !ok {
+		return fmt.Errorf("CloseRead not supported by %T", c.Conn)
+	}
+	return cr.CloseRead()
+}
+
+// SyscallConn implements syscall.Conn, so that socket options can be set on
+// the underlying connection.
+func (c *waitConn) SyscallConn() (syscall.RawConn, error) {
+	sc, ok := c.Conn.(syscall.Conn)
+	if !ok {
+		return nil, fmt.Errorf("SyscallConn not supported by %T", c.Conn)
+	}
+	return sc.SyscallConn()
+}
+
+// ReadFrom implements io.ReaderFrom, so that io.Copy can use the underlying
+// connection's optimizations (such as sendfile for TCP connections).
+func (c *waitConn) ReadFrom(r io.Reader) (n int64, err error) {
+	c.beginWrite()
+	defer c.endWrite()
+	if rf, ok := c.Conn.(io.ReaderFrom); ok && c.writeLimit == nil {
+		return rf.ReadFrom(r)
+	}
+	// Hide our ReadFrom method to avoid recursion
+	return io.Copy(struct{ io.Writer }{c}, r)
 }
 
 func (c *waitConn) Close() error {
 	err := fmt.Errorf("double close")
 	c.closeOnce.Do(func() {
-		defer c.Done()
+		defer c.listener.done(c)
+		if c.idle != nil {
+			c.idle.Stop()
+		}
 		Verbose.Printf("Closed connection: (local) %s <- %s (remote)",
 			c.LocalAddr(), c.RemoteAddr())
 		err = c.Conn.Close()
+		if onClose := c.listener.OnClose; onClose != nil {
+			onClose(c, time.Since(c.accepted))
+		}
 	})
 	return err
 }
@@ -52,14 +205,158 @@ func (c *waitConn) Close() error {
 // A WaitListener is a listener which accepts connections like a normal
 // Listener, but counts them and can Wait for all of them to close.
 type WaitListener struct {
+	// Statistics; these are first to ensure 64-bit alignment
+	accepted, closed, acceptErrors, rejected, shedConns int64
+
+	exhaustedSince int64 // UnixNano; nonzero while out of file descriptors
+
 	wg sync.WaitGroup
 	net.Listener
 	stop chan bool
+
+	deadlineMu sync.Mutex    // protects deadline changes after Stop or pause
+	paused     chan struct{} // non-nil while paused; closed by resume
+
+	// IdleTimeout, if nonzero, causes accepted connections to be closed
+	// automatically when there has been no activity on them for the given
+	// duration.  A connection is not idle while a Write (or ReadFrom) is in
+	// progress on it, however long it takes, but it is while a Read is
+	// blocked waiting for the peer, as on an idle keep-alive connection.  It
+	// should be set before the first Accept.
+	IdleTimeout time.Duration
+
+	// OnAccept, if set, is called with each accepted connection before it is
+	// returned from Accept.  OnClose, if set, is called with each connection
+	// after it has been closed, along with how long it was open.  They should
+	// be set before the first Accept, and may be called concurrently.
+	OnAccept func(conn net.Conn)
+	OnClose  func(conn net.Conn, open time.Duration)
+
+	// ConnRate and Rate, if nonzero, limit the bandwidth (in bytes per
+	// second, in each direction) of each connection and of all of the
+	// listener's connections together, respectively.  They should be set
+	// before the first Accept.  See also BandwidthFlags.
+	ConnRate, Rate int64
+
+	rateOnce            sync.Once
+	readRate, writeRate *rateLimiter
+
+	// Connections from addresses in the Allow networks are always accepted;
+	// otherwise, connections from addresses in the Deny networks are closed
+	// without being returned from Accept.  If only Allow is set, connections
+	// from all other addresses are closed.  They should be set before the
+	// first Accept.  See also AllowDenyFlags.
+	Allow, Deny []*net.IPNet
+
+	// OnAcceptError, if set, is called with each error returned by the
+	// underlying listener's Accept (other than those caused by stopping or
+	// closing the listener).  Temporary errors, such as ECONNABORTED or
+	// EMFILE, are not returned from Accept, which instead retries after
+	// an exponentially increasing delay.  It should be set before the
+	// first Accept, and may be called concurrently.
+	OnAcceptError func(err error)
+
+	// SpareFD, if set, causes the listener to reserve a spare file
+	// descriptor.  When Accept fails because the process has run out of
+	// file descriptors, the spare is used to accept and immediately close
+	// pending connections, so that clients get an error rather than
+	// waiting.  It should be set before the first Accept.
+	SpareFD bool
+
+	spareMu     sync.Mutex
+	spare       *os.File
+	spareClosed bool
+
+	connsMu sync.Mutex
+	conns   map[*waitConn]bool // open connections
+
+	// Linger, if not negative, is applied to each accepted connection which
+	// supports it (see net.TCPConn.SetLinger).  Zero causes connections to
+	// be reset when they are closed, discarding unsent data, which tears
+	// them down quickly; a positive value allows up to that many seconds
+	// for unsent data to be delivered.  It defaults to -1, which leaves the
+	// system default, and should be set before the first Accept.  See also
+	// LingerFlag.
+	Linger int
+
+	// DrainTimeout, if nonzero, is how long Shutdown and Restart (and a
+	// ListenerGroup's Wait) wait for the listener's connections to close,
+	// in place of the timeout they are given.  This allows, for instance,
+	// a bulk transfer port to drain for longer than an API port.  If it is
+	// zero, the given timeout applies, and the wait is unbounded only if
+	// that is zero too.  See also DrainTimeoutFlag.
+	DrainTimeout time.Duration
+}
+
+// NewWaitListener wraps the given listener so that its connections are
+// tracked.  This is useful for listeners which are not created by a
+// Listenable, such as those from tls.Listen or another library.  Note
+// that a WaitListener created this way is not passed on to the new
+// process by Restart; it is up to the caller to Stop or Close it.
+func NewWaitListener(l net.Listener) *WaitListener {
+	return &WaitListener{
+		Listener: l,
+		stop:     make(chan bool),
+		Linger:   -1,
+	}
 }
 
 // Accept is a wrapper around the underlying Listener's accept
-// to facilitate tracking connections.
+// to facilitate tracking connections.  Temporary errors from the
+// underlying Accept are retried; see OnAcceptError.
 func (w *WaitListener) Accept() (conn net.Conn, err error) {
+	return w.accept(nil)
+}
+
+// AcceptContext is like Accept, but also returns if the context is cancelled
+// or the daemon begins to shut down or restart (see Lamed).  The error
+// returned in that case matches ErrStopped with errors.Is; if the context was
+// cancelled, it also matches the context's error.  An Accept in progress can
+// only be interrupted if the underlying listener supports deadlines (as TCP
+// and Unix listeners do).
+func (w *WaitListener) AcceptContext(ctx context.Context) (net.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, &StoppedError{Err: err}
+	}
+	select {
+	case <-Lamed:
+		return nil, ErrStopped
+	default:
+	}
+
+	var interrupted bool
+	cause := make(chan error, 1)
+	done, finished := make(chan bool), make(chan bool)
+	go func() {
+		defer close(finished)
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+			cause <- &StoppedError{Err: ctx.Err()}
+		case <-Lamed:
+			cause <- ErrStopped
+		}
+		interrupted = true
+		if err := w.setDeadline(time.Unix(1, 0)); err != nil {
+			Verbose.Printf("Failed to interrupt Accept on %s: %s", w.Addr(), err)
+		}
+	}()
+
+	conn, err := w.accept(cause)
+	close(done)
+	<-finished
+	if interrupted {
+		if err := w.setDeadline(time.Time{}); err != nil {
+			Warning.Printf("Failed to clear deadline on %s: %s", w.Addr(), err)
+		}
+	}
+	return conn, err
+}
+
+// accept accepts a connection from the underlying listener.  If the Accept
+// fails and an error is available from cause, it is returned instead.
+func (w *WaitListener) accept(cause <-chan error) (conn net.Conn, err error) {
 	// To prevent race conditions, always assume we're going
 	// to accept a connection.
 	w.wg.Add(1)
@@ -70,27 +367,229 @@ func (w *WaitListener) Accept() (conn net.Conn, err error) {
 		}
 	}()
 
-	select {
-	case <-w.stop:
-		return nil, ErrStopped
-	default:
-	}
+	w.reserveSpare()
 
-	conn, err = w.Listener.Accept()
-	if err != nil {
-		if strings.Contains(err.Error(), "closed network connection") {
+	var delay time.Duration
+	for {
+		select {
+		case <-w.stop:
 			return nil, ErrStopped
+		default:
 		}
-		return nil, err
+
+		// Wait while the listener is paused
+		if paused := w.pausedChan(); paused != nil {
+			select {
+			case <-paused:
+			case <-w.stop:
+				return nil, ErrStopped
+			case err := <-cause:
+				return nil, err
+			}
+			continue
+		}
+
+		conn, err = w.Listener.Accept()
+		if err != nil {
+			select {
+			case <-w.stop:
+				// Stop interrupted the Accept
+				return nil, ErrStopped
+			case err := <-cause:
+				// AcceptContext interrupted the Accept
+				return nil, err
+			default:
+			}
+			if w.pausedChan() != nil {
+				// pause interrupted the Accept
+				continue
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return nil, &StoppedError{Err: err}
+			}
+			atomic.AddInt64(&w.acceptErrors, 1)
+			if w.OnAcceptError != nil {
+				w.OnAcceptError(err)
+			}
+			if fdExhausted(err) {
+				w.setExhausted(true)
+				if w.shed() {
+					continue
+				}
+			}
+			if ne, ok := err.(net.Error); !ok || !ne.Temporary() {
+				return nil, err
+			}
+
+			// Back off and retry temporary errors
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > time.Second {
+				delay = time.Second
+			}
+			Verbose.Printf("Accept error on %s: %s; retrying in %s", w.Addr(), err, delay)
+			timer := time.NewTimer(delay)
+			select {
+			case <-w.stop:
+				timer.Stop()
+				return nil, ErrStopped
+			case err := <-cause:
+				timer.Stop()
+				return nil, err
+			case <-timer.C:
+			}
+			continue
+		}
+		w.setExhausted(false)
+		if w.permitted(conn.RemoteAddr()) {
+			break
+		}
+
+		atomic.AddInt64(&w.rejected, 1)
+		Info.Printf("Rejected connection: (local) %s <- %s (remote)",
+			conn.LocalAddr(), conn.RemoteAddr())
+		conn.Close()
 	}
+	atomic.AddInt64(&w.accepted, 1)
 
 	Verbose.Printf("Accepted connection: (local) %s <- %s (remote)",
 		conn.LocalAddr(), conn.RemoteAddr())
 
-	return &waitConn{
-		WaitGroup: &w.wg,
-		Conn:      conn,
-	}, nil
+	if w.Linger >= 0 {
+		if lc, ok := conn.(interface{ SetLinger(sec int) error }); ok {
+			if err := lc.SetLinger(w.Linger); err != nil {
+				Verbose.Printf("Failed to set linger on %s: %s", conn.RemoteAddr(), err)
+			}
+		}
+	}
+
+	wc := &waitConn{
+		Conn:     conn,
+		listener: w,
+		accepted: time.Now(),
+	}
+	wc.active = wc.accepted.UnixNano()
+	wc.readLimit, wc.writeLimit = w.throttles()
+	w.track(wc)
+	if d := w.IdleTimeout; d > 0 {
+		wc.idleTimeout = d
+		wc.idle = time.AfterFunc(d, func() {
+			if wc.inWrite() {
+				// Check again once the timeout has passed anew
+				wc.idle.Reset(d)
+				return
+			}
+			Verbose.Printf("Idle connection timed out after %s: (local) %s <- %s (remote)",
+				d, conn.LocalAddr(), conn.RemoteAddr())
+			wc.Close()
+		})
+	}
+	if w.OnAccept != nil {
+		w.OnAccept(wc)
+	}
+	return wc, nil
+}
+
+// track records a newly accepted connection.
+func (w *WaitListener) track(c *waitConn) {
+	w.connsMu.Lock()
+	defer w.connsMu.Unlock()
+	if w.conns == nil {
+		w.conns = make(map[*waitConn]bool)
+	}
+	w.conns[c] = true
+}
+
+// done records that one of the listener's connections has closed.
+func (w *WaitListener) done(c *waitConn) {
+	w.connsMu.Lock()
+	delete(w.conns, c)
+	w.connsMu.Unlock()
+
+	atomic.AddInt64(&w.closed, 1)
+	w.wg.Done()
+}
+
+// Conns returns the listener's open connections.  A connection can be
+// forcibly closed by calling its Close method.
+func (w *WaitListener) Conns() []net.Conn {
+	w.connsMu.Lock()
+	defer w.connsMu.Unlock()
+	conns := make([]net.Conn, 0, len(w.conns))
+	for c := range w.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// SetConnDeadline sets the read and write deadline on all of the listener's
+// open connections, so that handlers blocked on them are interrupted.
+func (w *WaitListener) SetConnDeadline(t time.Time) {
+	for _, c := range w.Conns() {
+		if err := c.SetDeadline(t); err != nil {
+			Verbose.Printf("Failed to set deadline on %s: %s", c.RemoteAddr(), err)
+		}
+	}
+}
+
+// CloseConns forcibly closes all of the listener's open connections and
+// returns how many were closed.
+func (w *WaitListener) CloseConns() int {
+	conns := w.Conns()
+	for _, c := range conns {
+		Verbose.Printf("Forcibly closing connection: (local) %s <- %s (remote)",
+			c.LocalAddr(), c.RemoteAddr())
+		c.Close()
+	}
+	return len(conns)
+}
+
+// CloseIdle closes the listener's open connections on which there has been
+// no Read or Write for at least d, and returns how many were closed.  This
+// includes connections on which a Read has been blocked for that long, such
+// as idle keep-alive connections, but not those on which a Write is in
+// progress, such as a large response to a slow client.
+func (w *WaitListener) CloseIdle(d time.Duration) int {
+	cutoff := time.Now().Add(-d).UnixNano()
+
+	var n int
+	for _, c := range w.Conns() {
+		wc := c.(*waitConn)
+		if wc.inWrite() || atomic.LoadInt64(&wc.active) > cutoff {
+			continue
+		}
+		Verbose.Printf("Closing idle connection: (local) %s <- %s (remote)",
+			c.LocalAddr(), c.RemoteAddr())
+		c.Close()
+		n++
+	}
+	return n
+}
+
+// ConnStats holds connection statistics for a WaitListener.
+type ConnStats struct {
+	Open         int64 // Connections currently open
+	Accepted     int64 // Total connections accepted
+	Closed       int64 // Total connections closed
+	AcceptErrors int64 // Total errors from the underlying Accept
+	Rejected     int64 // Total connections rejected by Allow and Deny
+	Shed         int64 // Total connections shed using SpareFD
+}
+
+// Stats returns a snapshot of the listener's connection statistics.
+// It is safe to call at any time, including while the listener is
+// being drained.
+func (w *WaitListener) Stats() ConnStats {
+	closed := atomic.LoadInt64(&w.closed)
+	accepted := atomic.LoadInt64(&w.accepted)
+	return ConnStats{
+		Open:         accepted - closed,
+		Accepted:     accepted,
+		Closed:       closed,
+		AcceptErrors: atomic.LoadInt64(&w.acceptErrors),
+		Rejected:     atomic.LoadInt64(&w.rejected),
+		Shed:         atomic.LoadInt64(&w.shedConns),
+	}
 }
 
 // Close stops and closes the listener; it is an error to close more than once.
@@ -100,31 +599,116 @@ func (w *WaitListener) Close() error {
 		return fmt.Errorf("listener already closed")
 	default:
 		close(w.stop)
+		w.releaseSpare()
 
 		Verbose.Printf("Closing listener: %s", w.Addr())
 		return w.Listener.Close()
 	}
 }
 
-// Stop stops the listener so that it can be used in another process.  After
-// Stop, it may be necessary to create a dummy connection to this Listener to
-// fall out of an existing Accept.  It is an error to call Stop more than once.
+// A deadliner is a listener whose Accept can be interrupted by a deadline,
+// such as a *net.TCPListener or a *net.UnixListener.
+type deadliner interface {
+	SetDeadline(t time.Time) error
+}
+
+// Stop stops the listener so that it can be used in another process.  The
+// underlying listener is not closed, but an existing Accept will return
+// ErrStopped if the underlying listener supports deadlines (as TCP and Unix
+// listeners do).  It is an error to call Stop more than once.
 func (w *WaitListener) Stop() {
 	close(w.stop)
+	w.releaseSpare()
 
 	Verbose.Printf("Stopping listener: %s", w.Addr())
+
+	// Set a deadline in the past to fall out of an existing Accept.
+	if err := w.setDeadline(time.Unix(1, 0)); err != nil {
+		Verbose.Printf("Failed to interrupt Accept on %s: %s", w.Addr(), err)
+	}
+}
+
+// pause causes Accept to wait without accepting connections until the
+// listener is resumed or stopped, so that the process can stand by while
+// another one serves on the same socket.
+func (w *WaitListener) pause() {
+	w.deadlineMu.Lock()
+	if w.paused == nil {
+		w.paused = make(chan struct{})
+	}
+	w.deadlineMu.Unlock()
+
+	Verbose.Printf("Pausing listener: %s", w.Addr())
+	if err := w.setDeadline(time.Unix(1, 0)); err != nil {
+		Verbose.Printf("Failed to interrupt Accept on %s: %s", w.Addr(), err)
+	}
+}
+
+// resume undoes pause.
+func (w *WaitListener) resume() {
+	w.deadlineMu.Lock()
+	if w.paused != nil {
+		close(w.paused)
+		w.paused = nil
+	}
+	w.deadlineMu.Unlock()
+
+	Verbose.Printf("Resuming listener: %s", w.Addr())
+	w.setDeadline(time.Time{})
+}
+
+// pausedChan returns a channel which is closed when the listener is resumed,
+// or nil if it is not paused.
+func (w *WaitListener) pausedChan() <-chan struct{} {
+	w.deadlineMu.Lock()
+	defer w.deadlineMu.Unlock()
+	if w.paused == nil {
+		return nil
+	}
+	return w.paused
+}
+
+// setDeadline sets the deadline for Accept on the underlying listener.  Once
+// the listener has been stopped, and while it is paused, its deadline is
+// never cleared.
+func (w *WaitListener) setDeadline(t time.Time) error {
+	dl, ok := w.Listener.(deadliner)
+	if !ok {
+		return fmt.Errorf("deadlines not supported by %T", w.Listener)
+	}
+
+	w.deadlineMu.Lock()
+	defer w.deadlineMu.Unlock()
+	if t.IsZero() {
+		if w.paused != nil {
+			return nil
+		}
+		select {
+		case <-w.stop:
+			return nil
+		default:
+		}
+	}
+	return dl.SetDeadline(t)
+}
+
+// A filer is a listener whose file descriptor can be duplicated, such as
+// a *net.TCPListener or a *net.UnixListener.
+type filer interface {
+	File() (*os.File, error)
 }
 
 // File copies and the listener's underlying file descriptor.  This is intended
 // to be used to pass the file descriptor on to a restarted version of this
-// process.
+// process.  The underlying listener must have a File method, as TCP and Unix
+// listeners do.
 func (w *WaitListener) File() *os.File {
-	tcp, ok := w.Listener.(*net.TCPListener)
+	fl, ok := w.Listener.(filer)
 	if !ok {
 		Fatal.Printf("unknown listener type: %T", w.Listener)
 	}
 
-	lf, err := tcp.File()
+	lf, err := fl.File()
 	if err != nil {
 		Fatal.Printf("failed to get fd: %s", err)
 	}
@@ -136,78 +720,249 @@ func (w *WaitListener) Wait() {
 	w.wg.Wait()
 }
 
-// noop makes a dummy connection to the listener
-func (w *WaitListener) noop() {
-	addr := w.Addr().(*net.TCPAddr)
-	for _, ip := range []net.IP{
-		net.IPv4(127, 0, 0, 1),
-		net.IPv6loopback,
-		addr.IP,
-	} {
-		addr.IP = ip
-		conn, err := net.DialTCP("tcp", nil, addr)
-		if err != nil {
-			Verbose.Printf("noop(%q): %s", addr, err)
-			continue
-		}
-		defer conn.Close()
-		Verbose.Printf("noop(%q): Success", addr)
-		return
+// WaitTimeout waits up to d for all associated connections to close.  It
+// returns whether they did, and if not, how many remain open, so that the
+// caller can decide whether to keep waiting, close them, or give up.
+func (w *WaitListener) WaitTimeout(d time.Duration) (drained bool, remaining int) {
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		w.Wait()
+	}()
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true, 0
+	case <-timer.C:
+		return false, int(w.Stats().Open)
 	}
-	Verbose.Printf("noop(%q): failed to ping", addr)
 }
 
 // A Listenable is something which can listen.  It can either
 // be backed by a file descriptor of an existing listener,
 // or if none is available, a new listener.  String returns
-// the intended address for the listening socket as a string.
+// the intended address for the listening socket as a string,
+// or the actual address once it is listening.  Addr returns
+// the address to which the listener is bound, or nil if Listen
+// has not yet been called successfully; this is useful for
+// discovering the port chosen when listening on port 0.
+//
+// The Listenables provided by this package return a *WaitListener
+// from Listen.
 type Listenable interface {
 	Listen() (net.Listener, error)
+	Addr() net.Addr
 	String() string
 }
 
+// A configurable Listenable can apply settings from other flags to its
+// WaitListener when it is created.
+type configurable interface {
+	configure(fn func(*WaitListener))
+}
+
 type listenFlag struct {
 	flag, proto string
-	mode        string // "fd", "tcp"
+	mode        string // "fd", "tcp", "sctp", "unix"
 
 	// mode == "fd"
 	fd       int
 	listener *WaitListener
 
-	// mode == "tcp"
-	net   string
-	laddr *net.TCPAddr
+	// setup is applied to the listener when it is created
+	setup []func(*WaitListener)
+
+	// mode == "tcp", "sctp", or "unix"
+	net    string
+	defNet string // net as originally registered
+
+	// mode == "tcp" or "sctp"
+	laddr    *net.TCPAddr
+	lastPort int    // if nonzero, the last port in a range from laddr.Port
+	device   string // network interface to bind to, if any
+	sockopts SocketOptions
+
+	// set if bound with SO_REUSEPORT (see ReusePort)
+	reuseport bool
+
+	// mode == "unix"
+	uaddr *net.UnixAddr
+	unix  UnixOptions
 }
 
+// BindRetry specifies how long Listen will keep trying to bind a new
+// listening socket while its address is in use, such as when a previous
+// instance of the daemon is still draining without having passed on its
+// sockets.  If it is zero, Listen fails immediately.
+var BindRetry time.Duration
+
 func (l *listenFlag) Listen() (net.Listener, error) {
-	var under net.Listener
-	var err error
+	under, err := l.bind()
+	if err != nil {
+		return nil, err
+	}
+	Verbose.Printf("Listening for %s on: %s (from %s)", l.proto, under.Addr(), l.mode)
+	listener := NewWaitListener(under)
+	for _, fn := range l.setup {
+		fn(listener)
+	}
+	l.listener = listener
+	return listener, nil
+}
+
+// bind creates the underlying listener, retrying according to BindRetry.
+func (l *listenFlag) bind() (net.Listener, error) {
+	under, err := l.listen()
+	if errors.Is(err, syscall.EADDRINUSE) && BindRetry > 0 {
+		deadline := time.Now().Add(BindRetry)
+		delay := 100 * time.Millisecond
+		for errors.Is(err, syscall.EADDRINUSE) && time.Now().Before(deadline) {
+			Info.Printf("Address %s in use; retrying in %s", l, delay)
+			time.Sleep(delay)
+			if delay *= 2; delay > 2*time.Second {
+				delay = 2 * time.Second
+			}
+			under, err = l.listen()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if ul, ok := under.(*net.UnixListener); ok {
+		// Inherited sockets don't unlink by default, but whoever
+		// closes the listener for good should clean up after it.
+		ul.SetUnlinkOnClose(true)
+	}
+	return under, nil
+}
+
+// listen creates the underlying listener.
+func (l *listenFlag) listen() (under net.Listener, err error) {
 	switch l.mode {
 	case "fd":
 		f := os.NewFile(uintptr(l.fd), fmt.Sprintf("&%d", l.fd))
 		under, err = net.FileListener(f)
-	case "tcp":
-		under, err = net.ListenTCP(l.net, l.laddr)
+	case "tcp", "sctp":
+		// Try each port in the range, if any, in turn
+		for port := l.laddr.Port; ; port++ {
+			laddr := *l.laddr
+			laddr.Port = port
+			under, err = l.listenIP(&laddr)
+			if !errors.Is(err, syscall.EADDRINUSE) || port >= l.lastPort {
+				break
+			}
+			Verbose.Printf("Address %s in use; trying the next port", &laddr)
+		}
+	case "unix":
+		under, err = listenUnix(l.net, l.uaddr, l.unix)
 	default:
 		return nil, fmt.Errorf("unknown mode %q", l.mode)
 	}
-	if err != nil {
-		return nil, err
+	return under, err
+}
+
+// listenIP creates a TCP or SCTP listener on the given address.
+func (l *listenFlag) listenIP(laddr *net.TCPAddr) (net.Listener, error) {
+	if l.mode == "sctp" {
+		return listenSCTP(l.net, laddr, l.control)
 	}
-	Verbose.Printf("Listening for %s on: %s (from %s)", l.proto, under.Addr(), l.mode)
-	listener := &WaitListener{
-		Listener: under,
-		stop:     make(chan bool),
+	lc := net.ListenConfig{Control: l.control}
+	return lc.Listen(context.Background(), l.net, laddr.String())
+}
+
+func (l *listenFlag) configure(fn func(*WaitListener)) {
+	l.setup = append(l.setup, fn)
+}
+
+func (l *listenFlag) Addr() net.Addr {
+	if l.listener == nil {
+		return nil
 	}
-	l.listener = listener
-	return listener, nil
+	return l.listener.Addr()
 }
 
 func (l *listenFlag) String() string {
+	if l.listener != nil {
+		return l.listener.Addr().String()
+	}
+	if l.uaddr != nil {
+		return l.uaddr.String()
+	}
+	if l.laddr == nil {
+		return ""
+	}
+	var prefix string
+	if l.net != l.defNet {
+		prefix = l.net + ":"
+	}
+	var suffix string
+	if l.lastPort != 0 {
+		suffix = fmt.Sprintf("-%d", l.lastPort)
+	}
+	if l.device != "" {
+		suffix += "@" + l.device
+	}
 	if l.laddr.IP == nil {
-		return fmt.Sprintf(":%d", l.laddr.Port)
+		return fmt.Sprintf("%s:%d%s", prefix, l.laddr.Port, suffix)
+	}
+	return prefix + l.laddr.String() + suffix
+}
+
+// resolve resolves the address s according to the flag's network.
+func (l *listenFlag) resolve(s string) error {
+	l.device, l.lastPort = "", 0
+	if !strings.HasPrefix(l.net, "unix") {
+		// Check for a network interface (e.g. ":80@eth0")
+		if i := strings.LastIndex(s, "@"); i >= 0 {
+			s, l.device = s[:i], s[i+1:]
+		}
+
+		// Check for a port range (e.g. ":8000-8100")
+		if host, port, err := net.SplitHostPort(s); err == nil {
+			if first, last, ok := strings.Cut(port, "-"); ok {
+				lo, err1 := strconv.Atoi(first)
+				hi, err2 := strconv.Atoi(last)
+				if err1 != nil || err2 != nil || lo <= 0 || hi < lo || hi > 65535 {
+					return fmt.Errorf("bad port range %q", port)
+				}
+				s, l.lastPort = net.JoinHostPort(host, first), hi
+			}
+		}
+	}
+
+	switch l.net {
+	case "unix", "unixpacket":
+		uaddr, err := net.ResolveUnixAddr(l.net, s)
+		if err != nil {
+			return fmt.Errorf("failed to resolve %q: %s", s, err)
+		}
+		l.mode, l.uaddr = "unix", uaddr
+		return nil
+	case "sctp", "sctp4", "sctp6":
+		// SCTP addresses are resolved the same way as TCP addresses
+		laddr, err := net.ResolveTCPAddr("tcp"+strings.TrimPrefix(l.net, "sctp"), s)
+		if err != nil {
+			return fmt.Errorf("failed to resolve %q: %s", s, err)
+		}
+		l.mode, l.laddr = "sctp", laddr
+		return nil
+	}
+
+	laddr, err := net.ResolveTCPAddr(l.net, s)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %q: %s", s, err)
 	}
-	return l.laddr.String()
+	l.mode, l.laddr = "tcp", laddr
+	return nil
+}
+
+// listenNets are the networks which may be specified as a prefix on the
+// value of a TCP or SCTP ListenFlag.
+var listenNets = map[string]bool{
+	"tcp": true, "tcp4": true, "tcp6": true,
+	"sctp": true, "sctp4": true, "sctp6": true,
 }
 
 func (l *listenFlag) Set(s string) error {
@@ -215,6 +970,14 @@ func (l *listenFlag) Set(s string) error {
 		return fmt.Errorf("--%s requires an argument", l.flag)
 	}
 
+	// Check for an explicit network (e.g. "tcp4:1.2.3.4:80")
+	if netw, addr, ok := strings.Cut(s, ":"); ok && listenNets[netw] && listenNets[l.net] {
+		if strings.HasPrefix(netw, "tcp") != strings.HasPrefix(l.net, "tcp") {
+			return fmt.Errorf("--%s: cannot listen on %s", l.flag, netw)
+		}
+		l.net, s = netw, addr
+	}
+
 	// Check for passed file descriptor
 	if s[0] == '&' {
 		fd, err := strconv.Atoi(s[1:])
@@ -225,31 +988,56 @@ func (l *listenFlag) Set(s string) error {
 		return nil
 	}
 
-	laddr, err := net.ResolveTCPAddr(l.net, s)
-	if err != nil {
-		return fmt.Errorf("failed to resolve %q: %s", s, err)
-	}
-	l.mode, l.laddr = "tcp", laddr
-	return nil
+	return l.resolve(s)
 }
 
 // ListenFlag registers a flag, which, when set, causes the returned
 // Listenable to listen on the provided address.  If the flag is not
 // provided, the default addr will be used.  The given proto is used
-// to create the help text.
+// to create the help text.  A port of 0 (e.g. ":0") causes the
+// system to choose an available port; use Addr after Listen to
+// discover it.
+//
+// If netw is "unix" or "unixpacket", the address is the path to a
+// Unix domain socket; see UnixListenFlag to control its permissions.
+// If netw is "sctp", "sctp4", or "sctp6", a one-to-one style SCTP
+// socket is created (on linux only); its connections are presented
+// as TCP connections.
+//
+// For "tcp" and "sctp", a wildcard address listens on both IPv4 and IPv6
+// (dual-stack) where available; "tcp4" and "tcp6" (or "sctp4" and "sctp6")
+// listen only on IPv4 or IPv6 respectively.  The network may also be
+// overridden in the flag value by prefixing the address with it, as in
+// "tcp6:[::]:80" or "tcp4::80".
+//
+// On linux, a TCP or SCTP listener can be bound to a particular network
+// interface (using SO_BINDTODEVICE) by suffixing the address with "@"
+// and the interface name, as in ":80@eth0".
+//
+// A TCP or SCTP address may specify a range of ports, as in ":8000-8100",
+// in which case Listen binds the first one which is not in use; use Addr
+// after Listen to discover which one.
 func ListenFlag(name, netw, addr, proto string) Listenable {
-	laddr, err := net.ResolveTCPAddr(netw, addr)
-	if err != nil {
+	f := &listenFlag{
+		flag:   name,
+		proto:  proto,
+		net:    netw,
+		defNet: netw,
+	}
+	if err := f.resolve(addr); err != nil {
 		Fatal.Printf("failed to resolve default %q: %s", addr, err)
 	}
+	inherit(name, f)
+	FlagSet.Var(f, name, fmt.Sprintf("Address on which to listen for %s", proto))
+	return f
+}
 
-	f := &listenFlag{
-		flag:  name,
-		proto: proto,
-		mode:  "tcp",
-		net:   netw,
-		laddr: laddr,
-	}
-	flag.Var(f, name, fmt.Sprintf("Address on which to listen for %s", proto))
+// UnixListenFlag is like ListenFlag for a Unix domain socket at the given
+// path, but additionally applies the given options to the socket file when
+// it is created.  Since the socket is created in Listen, this should be
+// called before dropping privileges if the ownership is to be changed.
+func UnixListenFlag(name, path, proto string, opts UnixOptions) Listenable {
+	f := ListenFlag(name, "unix", path, proto).(*listenFlag)
+	f.unix = opts
 	return f
 }
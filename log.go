@@ -15,19 +15,33 @@
 package daemon
 
 import (
-	"flag"
+	"bufio"
 	"fmt"
 	"io"
-	"log"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
+	"time"
 )
 
 var (
 	logPrefix = fmt.Sprintf("[%d] ", os.Getpid())
-	logFlags  = log.Ldate | log.Lmicroseconds | log.Lshortfile
 	logFile   = os.Stderr
-	logger    = log.New(logFile, logPrefix, logFlags)
+
+	// logStderr is the standard error to which log messages are written,
+	// which is not os.Stderr once that is captured (see CaptureOutput)
+	logStderr io.Writer = os.Stderr
+
+	// logWriter is where log messages are written
+	logWriter io.Writer = logStderr
+
+	// childStdout and childStderr are the standard output and error given
+	// to new processes
+	childStdout = os.Stdout
+	childStderr = os.Stderr
 )
 
 // A Logger is a level-filtered log writer.
@@ -61,16 +75,31 @@ func V(level int) Logger {
 // destined for an equal or higher level will be written.
 var LogLevel = Info
 
-func (l Logger) prefix() string {
+// noLevel is the Logger for messages which have no level of their own, such
+// as the output of programs.  It is only used internally.
+const noLevel Logger = -100
+
+// level returns the name of the level at which messages are logged.
+func (l Logger) level() string {
 	switch l {
-	case Error, Fatal:
-		return "E: "
+	case noLevel:
+		return ""
+	case Error, Fatal, Exit:
+		return "error"
 	case Warning:
-		return "W: "
+		return "warning"
 	case Info:
-		return "I: "
+		return "info"
 	}
-	return "V: "
+	return "verbose"
+}
+
+// levelPrefixes are the prefixes of messages at each level in the text format.
+var levelPrefixes = map[string]string{
+	"error":   "E: ",
+	"warning": "W: ",
+	"info":    "I: ",
+	"verbose": "V: ",
 }
 
 func stack() string {
@@ -92,32 +121,167 @@ func stack() string {
 
 // Printf formats the log message and writes it to the log if the level is
 // sufficient.  If the message is directed at Exit or Fatal, the binary will
-// terminate after the log message is written.  If the message is directed to
-// Fatal or lower, a stack trace of all goroutines will also be written to the
-// log before exiting.  If the logger is Warning or higher, the log will be
-// Sync'd after writing.
+// terminate after the log message is written, once the AtExit hooks have been
+// called.  If the message is directed to Fatal or lower, a stack trace of all
+// goroutines will also be written to the log before exiting.  If the logger
+// is Warning or higher, the log will be Sync'd after writing.
 func (l Logger) Printf(format string, args ...interface{}) {
 	if l > LogLevel {
 		return
 	}
-	msg := fmt.Sprintf(l.prefix()+format, args...)
+	msg := fmt.Sprintf(format, args...)
 	if l <= Fatal {
 		msg += "\n" + stack()
 	}
-	logger.Output(2, msg)
+	output(2, l, msg)
 	if l < Info {
 		logFile.Sync()
 	}
 	if l == Exit || l == Fatal {
-		os.Exit(1)
+		exitProcess(1)
+	}
+}
+
+// output writes msg to the log at the given level.  Calldepth counts the
+// callers to skip to find the file and line to report, as in
+// log.Logger.Output, except that output itself is not counted.
+func output(calldepth int, l Logger, msg string) {
+	var pcs [1]uintptr
+	runtime.Callers(calldepth+1, pcs[:])
+	emit(time.Now(), pcs[0], l, msg)
+}
+
+// emit writes msg, logged at time t by the code at pc, to the log (or passes
+// it to the slog.Handler set by SetSlogHandler).
+func emit(t time.Time, pc uintptr, l Logger, msg string) {
+	if delegate != nil {
+		delegate(t, pc, l, msg)
+		return
+	}
+	writeEntry(t, pc, l, msg)
+}
+
+// writeEntry writes msg, logged at time t by the code at pc, to the log in
+// the LogFormat.
+func writeEntry(t time.Time, pc uintptr, l Logger, msg string) {
+	file, line := "???", 0
+	if pc != 0 {
+		frame, _ := runtime.CallersFrames([]uintptr{pc}).Next()
+		file, line = filepath.Base(frame.File), frame.Line
+	}
+	if toSinks(&logEntry{t, l, file, line, msg}) {
+		return
+	}
+	switch LogFormat {
+	case "json":
+		rec := jsonRecord{
+			Time:  t.Format(jsonTimeFormat),
+			PID:   os.Getpid(),
+			Level: l.level(),
+			File:  fmt.Sprintf("%s:%d", file, line),
+			Msg:   msg,
+		}
+		writeLog(rec.encode())
+	case "logfmt":
+		writeLog(logfmtRecord(t, l.level(), fmt.Sprintf("%s:%d", file, line), msg))
+	default:
+		// The format of the standard log package with Lshortfile
+		msg = fmt.Sprintf("%s%s %s:%d: %s%s", logPrefix, t.Format("2006/01/02 15:04:05.000000"),
+			file, line, levelPrefixes[l.level()], msg)
+		if !strings.HasSuffix(msg, "\n") {
+			msg += "\n"
+		}
+		writeLog([]byte(msg))
 	}
 }
 
+// delegate, if set, is called by emit in place of writing to the log.
+var delegate func(t time.Time, pc uintptr, l Logger, msg string)
+
+// A logEntry is a message written to the log, as passed to a logSink.
+type logEntry struct {
+	time  time.Time
+	level Logger
+	file  string
+	line  int
+	msg   string
+}
+
+// A logSink receives each message written to the log, such as to send it to
+// syslog, in addition to standard error and the LogFileFlag file, or instead
+// of them if only is set.
+type logSink struct {
+	write func(e *logEntry)
+	only  *bool
+}
+
+// logSinks are added by addLogSink.
+var logSinks []logSink
+
+func addLogSink(s logSink) {
+	logMu.Lock()
+	defer logMu.Unlock()
+	logSinks = append(logSinks, s)
+}
+
+// toSinks passes e to the logSinks, and returns whether it should be written
+// only to them.
+func toSinks(e *logEntry) (only bool) {
+	logMu.Lock()
+	sinks := logSinks
+	logMu.Unlock()
+
+	for _, s := range sinks {
+		s.write(e)
+		if s.only != nil && *s.only {
+			only = true
+		}
+	}
+	return only
+}
+
+// logLines writes each line read from r to the log with the given prefix
+// until r is closed.
+func logLines(r io.ReadCloser, prefix string) {
+	defer r.Close()
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		output(1, noLevel, prefix+s.Text())
+	}
+	if err := s.Err(); err != nil {
+		Error.Printf("Failed to read %s: %s", strings.TrimSuffix(prefix, ": "), err)
+	}
+}
+
+// CaptureOutput causes the processes started by Restart and Fork to write
+// their standard output and error to the log, one line at a time, with each
+// line prefixed by "stdout: " or "stderr: ".  Each process captures its own
+// output as it starts (see CaptureStdout), rather than this one doing so, so
+// that the output is not lost once this process exits.  CaptureOutput has no
+// effect on windows.
+var CaptureOutput = false
+
+// captureOutputEnv is the environment variable through which a process tells
+// the one it starts to capture its output (see CaptureOutput).
+const captureOutputEnv = "DAEMON_CAPTURE_OUTPUT"
+
+// passCaptureOutput tells the process started by cmd to capture its output,
+// if CaptureOutput is set.
+func passCaptureOutput(cmd *exec.Cmd) {
+	if !CaptureOutput {
+		return
+	}
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, captureOutputEnv+"=1")
+}
+
 // LogLevelFlag registers a flag with the given name which, when set, causes
 // only log messages of equal or higher level to be logged.  A pointer to the
 // log level chosen is returned.
 func LogLevelFlag(name string) *Logger {
-	flag.IntVar((*int)(&LogLevel), name, int(LogLevel), "Log level (0=Error, 1=Warning, 2=Info, 3+Verbose)")
+	FlagSet.IntVar((*int)(&LogLevel), name, int(LogLevel), "Log level (0=Error, 1=Warning, 2=Info, 3+Verbose)")
 	return &LogLevel
 }
 
@@ -130,24 +294,53 @@ func (f *logFileFlag) String() string {
 }
 
 func (f *logFileFlag) Set(s string) error {
-	file, err := os.OpenFile(s, os.O_WRONLY|os.O_APPEND|os.O_CREATE, f.mode)
+	if m, ok := managed(); ok {
+		Info.Printf("Not logging to %s: managed by %s, logging to stderr", s, m)
+		return nil
+	}
+	file, err := openLogFile(s, f.mode)
 	if err != nil {
 		return err
 	}
-	logger = log.New(io.MultiWriter(os.Stderr, file), logPrefix, logFlags)
+	logMu.Lock()
+	logWriter = io.MultiWriter(logStderr, file)
+	logMu.Unlock()
 	logFile = file
 	redirectStdout() // provided in OS-specific files
 	return nil
 }
 
+// openLogFile opens the log file for appending.  If s is of the form
+// "&fd:path", the log file at path has been opened already (such as by the
+// process which Restarted this one) as the given file descriptor.
+func openLogFile(s string, mode os.FileMode) (*os.File, error) {
+	if fdstr, path, ok := strings.Cut(s, ":"); ok && strings.HasPrefix(fdstr, "&") {
+		fd, err := strconv.Atoi(fdstr[1:])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse &fd: %s", err)
+		}
+		file := os.NewFile(uintptr(fd), path)
+		if _, err := file.Stat(); err != nil {
+			return nil, fmt.Errorf("inherited log file %s: %s", path, err)
+		}
+		return file, nil
+	}
+	return os.OpenFile(s, os.O_WRONLY|os.O_APPEND|os.O_CREATE, mode)
+}
+
 // LogFileFlag registers a flag with the given name which, when set,
 // causes daemon logs to be sent to the given file in addition to
 // standard error.  A pointer to the file is also returned,
 // which can be used for a deferred Close in main.
+//
+// Restart and Fork pass the open file on to the new process, unless
+// InheritViaEnv is set, so that it can continue to write to it even if it
+// could not open it, such as after dropping privileges.  The flag is ignored
+// if AutoDetect is set and the process is managed by systemd or a container.
 func LogFileFlag(name string, mode os.FileMode) **os.File {
 	fileFlag := &logFileFlag{
 		mode: mode,
 	}
-	flag.Var(fileFlag, name, "Log file (also writes to stderr if set)")
+	FlagSet.Var(fileFlag, name, "Log file (also writes to stderr if set)")
 	return &logFile
 }
@@ -17,7 +17,9 @@
 package daemon
 
 import (
+	"fmt"
 	"os"
+	"strings"
 	"syscall"
 )
 
@@ -34,3 +36,84 @@ func redirectStdout() {
 
 	syscall.Dup2(int(logFile.Fd()), int(os.Stderr.Fd()))
 }
+
+func init() {
+	if os.Getenv(captureOutputEnv) == "" {
+		return
+	}
+	os.Unsetenv(captureOutputEnv)
+
+	// Pass it on in turn when this process starts another
+	CaptureOutput = true
+	if err := CaptureStdout(); err != nil {
+		Warning.Printf("Failed to capture output: %s", err)
+		return
+	}
+	if err := captureStderr(); err != nil {
+		Warning.Printf("Failed to capture output: %s", err)
+	}
+}
+
+// CaptureStdout causes anything written to standard output by this process,
+// including by libraries and by subprocesses which share it, to be written to
+// the log instead, one line at a time, with each line prefixed by "stdout: ".
+//
+// Processes started by Restart and Fork are given the original standard
+// output rather than the one captured by this process, so that they are not
+// affected when it exits; see CaptureOutput to have them capture their own.
+func CaptureStdout() error {
+	orig, err := capture(os.Stdout, "stdout: ")
+	if err != nil {
+		return err
+	}
+	childStdout = orig
+	return nil
+}
+
+// captureStderr is like CaptureStdout, but for standard error, with each line
+// prefixed by "stderr: ".  Log messages are written to the original standard
+// error from then on.  Since RedirectStdout points standard error at the
+// LogFileFlag file, once that is set, the output from then on (including
+// panic traces, which would be lost if the process crashed before they were
+// read) is written there directly.
+func captureStderr() error {
+	orig, err := capture(os.Stderr, "stderr: ")
+	if err != nil {
+		return err
+	}
+	logMu.Lock()
+	if logWriter == logStderr {
+		logWriter = orig
+	}
+	logStderr = orig
+	logMu.Unlock()
+	childStderr = orig
+	return nil
+}
+
+// capture redirects f to a pipe from which lines are written to the log with
+// the given prefix, and returns a copy of the original file.
+func capture(f *os.File, prefix string) (*os.File, error) {
+	name := strings.TrimSuffix(prefix, ": ")
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pipe: %s", err)
+	}
+	defer w.Close()
+
+	fd := int(f.Fd())
+	orig, err := syscall.Dup(fd)
+	if err != nil {
+		r.Close()
+		return nil, fmt.Errorf("failed to dup %s: %s", name, err)
+	}
+	syscall.CloseOnExec(orig)
+	if err := syscall.Dup2(int(w.Fd()), fd); err != nil {
+		r.Close()
+		syscall.Close(orig)
+		return nil, fmt.Errorf("failed to redirect %s: %s", name, err)
+	}
+
+	go logLines(r, prefix)
+	return os.NewFile(uintptr(orig), name), nil
+}
@@ -0,0 +1,118 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogFormat is the format in which log messages are written:
+//
+//	text    the default, a human-readable line with a prefix like that of
+//	        the standard log package, and a letter giving the level
+//	json    a JSON object per line, with time, pid, level, file, and msg
+//	        fields, for ingestion by log collectors
+//	logfmt  a line of key=value pairs, with ts, pid, level, caller, and msg
+//	        keys, quoting values where necessary
+//
+// It should be set before anything is logged.  See also LogFormatFlag.
+var LogFormat = "text"
+
+// logFormats are the valid values of LogFormat.
+var logFormats = []string{"text", "json", "logfmt"}
+
+type logFormatFlag struct{}
+
+func (logFormatFlag) String() string {
+	return LogFormat
+}
+
+func (logFormatFlag) Set(s string) error {
+	for _, f := range logFormats {
+		if s == f {
+			LogFormat = s
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown log format %q (want one of %s)", s, strings.Join(logFormats, ", "))
+}
+
+// LogFormatFlag registers a flag with the given name which sets LogFormat.
+// It should be given before a LogFileFlag, if any, on the command line, so
+// that the format applies to the messages logged when the file is opened.
+func LogFormatFlag(name string) {
+	FlagSet.Var(logFormatFlag{}, name, fmt.Sprintf("Log format (%s)", strings.Join(logFormats, ", ")))
+}
+
+// jsonTimeFormat is the format of the time field of JSON log messages.
+const jsonTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// A jsonRecord is a log message in the json LogFormat.
+type jsonRecord struct {
+	Time  string `json:"time"`
+	PID   int    `json:"pid"`
+	Level string `json:"level,omitempty"`
+	File  string `json:"file"`
+	Msg   string `json:"msg"`
+}
+
+// encode returns the record as a line of JSON.
+func (r jsonRecord) encode() []byte {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(r) // can't fail; invalid UTF-8 is replaced
+	return buf.Bytes()
+}
+
+// logfmtRecord returns a log message in the logfmt LogFormat.
+func logfmtRecord(t time.Time, level, caller, msg string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "ts=%s pid=%d", t.Format(jsonTimeFormat), os.Getpid())
+	if level != "" {
+		b.WriteString(" level=" + level)
+	}
+	b.WriteString(" caller=" + logfmtValue(caller))
+	b.WriteString(" msg=" + logfmtValue(msg) + "\n")
+	return []byte(b.String())
+}
+
+// logfmtValue quotes s if it is empty or contains spaces, quotes, equals
+// signs, or control characters.
+func logfmtValue(s string) string {
+	if s == "" || strings.IndexFunc(s, func(r rune) bool {
+		return r <= ' ' || r == '"' || r == '=' || r == 0x7f
+	}) >= 0 {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// logMu serializes writes to the log.
+var logMu sync.Mutex
+
+// writeLog writes a formatted log message to the log.
+func writeLog(b []byte) {
+	logMu.Lock()
+	defer logMu.Unlock()
+	logWriter.Write(b)
+}
@@ -0,0 +1,207 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// A PacketListenable is like a Listenable for packet-oriented sockets, such
+// as the UDP socket underlying a QUIC server.  It can either be backed by a
+// file descriptor inherited from a previous process, or if none is available,
+// a new socket.  String returns the intended address for the socket as a
+// string, or the actual address once it is bound.  Addr returns the address
+// to which the socket is bound, or nil if ListenPacket has not yet been called
+// successfully.
+type PacketListenable interface {
+	ListenPacket() (net.PacketConn, error)
+	Addr() net.Addr
+	String() string
+}
+
+type packetFlag struct {
+	flag, proto string
+	mode        string // "fd", "udp"
+
+	// mode == "fd"
+	fd   int
+	conn net.PacketConn
+
+	// mode == "udp"
+	net   string
+	laddr *net.UDPAddr
+
+	routing *stateFlag // see PacketRouting
+}
+
+func (p *packetFlag) ListenPacket() (net.PacketConn, error) {
+	var conn net.PacketConn
+	var err error
+	switch p.mode {
+	case "fd":
+		f := os.NewFile(uintptr(p.fd), fmt.Sprintf("&%d", p.fd))
+		conn, err = net.FilePacketConn(f)
+		f.Close()
+	case "udp":
+		conn, err = net.ListenUDP(p.net, p.laddr)
+	default:
+		return nil, fmt.Errorf("unknown mode %q", p.mode)
+	}
+	if err != nil {
+		return nil, err
+	}
+	Verbose.Printf("Listening for %s on: %s (from %s)", p.proto, conn.LocalAddr(), p.mode)
+	p.conn = conn
+	return conn, nil
+}
+
+// files copies the socket's underlying file descriptor, followed by a pipe
+// from which the new process can read the routing state, if any.  The state
+// is not passed on if inPlace is set (see copyFlags).
+func (p *packetFlag) files(inPlace bool) []*os.File {
+	files := []*os.File{p.file()}
+	if p.routing != nil && !inPlace {
+		files = append(files, p.routing.file())
+	}
+	return files
+}
+
+// file copies the socket's underlying file descriptor so that it can be
+// passed on to a restarted version of this process.
+func (p *packetFlag) file() *os.File {
+	udp, ok := p.conn.(*net.UDPConn)
+	if !ok {
+		Fatal.Printf("unknown packet conn type: %T", p.conn)
+	}
+
+	f, err := udp.File()
+	if err != nil {
+		Fatal.Printf("failed to get fd: %s", err)
+	}
+	return f
+}
+
+func (p *packetFlag) Addr() net.Addr {
+	if p.conn == nil {
+		return nil
+	}
+	return p.conn.LocalAddr()
+}
+
+func (p *packetFlag) String() string {
+	if p.conn != nil {
+		return p.conn.LocalAddr().String()
+	}
+	if p.laddr == nil {
+		return ""
+	}
+	if p.laddr.IP == nil {
+		return fmt.Sprintf(":%d", p.laddr.Port)
+	}
+	return p.laddr.String()
+}
+
+func (p *packetFlag) Set(s string) error {
+	if len(s) == 0 {
+		return fmt.Errorf("--%s requires an argument", p.flag)
+	}
+
+	// Check for passed file descriptor, followed by the routing state, if any
+	if s[0] == '&' {
+		sock, state, hasState := strings.Cut(s, ",")
+		fd, err := strconv.Atoi(sock[1:])
+		if err != nil {
+			return fmt.Errorf("failed to parse &fd: %s", err)
+		}
+		p.mode, p.fd = "fd", fd
+		if !hasState {
+			return nil
+		}
+		routing := p.routing
+		if routing == nil {
+			// Drain the state, which this binary has no use for
+			routing = &stateFlag{flag: p.flag, load: func(io.Reader) error { return nil }}
+		}
+		return routing.Set(state)
+	}
+
+	laddr, err := net.ResolveUDPAddr(p.net, s)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %q: %s", s, err)
+	}
+	p.mode, p.laddr = "udp", laddr
+	return nil
+}
+
+// PacketFlag registers a flag, which, when set, causes the returned
+// PacketListenable to bind a UDP socket on the provided address.  If the
+// flag is not provided, the default addr will be used.  The given proto is
+// used to create the help text.
+//
+// Like a ListenFlag, the bound socket is passed on to the new process by
+// Restart, so that datagrams for in-flight connections (such as QUIC
+// connections) continue to arrive at the same socket.  Once the new process
+// has been started, the socket is closed in the old one.  The connection
+// state needed to route those datagrams (such as QUIC connection IDs) can be
+// handed to the new process along with the socket with PacketRouting.
+func PacketFlag(name, netw, addr, proto string, opts ...PacketOption) PacketListenable {
+	laddr, err := net.ResolveUDPAddr(netw, addr)
+	if err != nil {
+		Fatal.Printf("failed to resolve default %q: %s", addr, err)
+	}
+
+	p := &packetFlag{
+		flag:  name,
+		proto: proto,
+		mode:  "udp",
+		net:   netw,
+		laddr: laddr,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	inherit(name, p)
+	FlagSet.Var(p, name, fmt.Sprintf("Address on which to listen for %s", proto))
+	return p
+}
+
+// A PacketOption configures the PacketListenable returned by PacketFlag.
+type PacketOption func(*packetFlag)
+
+// PacketRouting causes Restart to hand the state needed to route datagrams
+// arriving on the socket, such as a QUIC server's table of connection IDs, to
+// the new process along with the socket.  As with a StateFlag, save is called
+// in the old process to write the state when the new process is started, and
+// load is called in the new process to read it when the flag is set, before
+// ListenPacket.  If load returns an error, flag parsing fails.  The state is
+// not passed on if ExecInPlace is set.
+//
+// Connections which the old process accepts after save is called are not
+// known to the new one, so the old process should stop accepting new ones
+// before the snapshot is taken, such as in an OnRestart hook.
+func PacketRouting(save func(w io.Writer) error, load func(r io.Reader) error) PacketOption {
+	return func(p *packetFlag) {
+		p.routing = &stateFlag{
+			flag: p.flag,
+			save: save,
+			load: load,
+		}
+	}
+}
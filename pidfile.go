@@ -0,0 +1,179 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// PIDFileEnv is the environment variable through which Restart and Fork pass
+// the new process the locked pidfile, so that the lock is held throughout.
+const PIDFileEnv = "DAEMON_PIDFILE_FD"
+
+// pidFile is the locked pidfile, if any.
+var pidFile *os.File
+
+// errLocked is returned by lockFile if another process holds the lock.
+var errLocked = errors.New("locked by another process")
+
+// openPIDFile returns the pidfile at path, locked so that no other instance
+// of the daemon can use it, or the locked pidfile passed by the previous
+// process, if any.
+func openPIDFile(path string) (*os.File, error) {
+	if env := os.Getenv(PIDFileEnv); env != "" {
+		os.Unsetenv(PIDFileEnv)
+		fd, err := strconv.Atoi(env)
+		if err != nil {
+			return nil, fmt.Errorf("bad %s %q: %s", PIDFileEnv, env, err)
+		}
+		return os.NewFile(uintptr(fd), path), nil
+	}
+
+	f, err := lockPIDFile(path)
+	if errors.Is(err, errLocked) && ForcePIDFile {
+		Warning.Printf("Taking over pidfile: %s", err)
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+		f, err = lockPIDFile(path)
+	}
+	return f, err
+}
+
+// lockPIDFile opens and locks the pidfile at path.
+func lockPIDFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	pid := strings.TrimSpace(string(b))
+
+	if err := lockFile(f, pid); err != nil { // provided in OS-specific files
+		if err == errLocked {
+			err = fmt.Errorf("%s is %w (pid %s)", path, err, pid)
+		}
+		f.Close()
+		return nil, err
+	}
+	if pid != "" {
+		// Whatever wrote it no longer holds the lock, so it's gone
+		Info.Printf("Replacing stale pidfile %s (pid %s)", path, pid)
+	}
+	return f, nil
+}
+
+// ForcePIDFile, if set, causes Fork to take over the pidfile even if another
+// instance of the daemon appears to be running, rather than exiting.  The
+// other instance is not stopped.
+var ForcePIDFile = false
+
+// ForcePIDFileFlag registers a flag with the given name which sets
+// ForcePIDFile.
+func ForcePIDFileFlag(name string) {
+	FlagSet.BoolVar(&ForcePIDFile, name, false, "Take over the pidfile even if another instance is running")
+}
+
+// writePID replaces the contents of the pidfile with the given PID.
+func writePID(f *os.File, pid int) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	_, err := f.WriteAt([]byte(fmt.Sprintf("%d\n", pid)), 0)
+	return err
+}
+
+// recordedPID is the PID last written to the pidfile by this process.
+var recordedPID int
+
+// recordPID writes the given PID to the locked pidfile, if any, such as when
+// a new process has been started to take over from this one.
+func recordPID(pid int) {
+	if pidFile == nil {
+		return
+	}
+	if err := writePID(pidFile, pid); err != nil {
+		Warning.Printf("Failed to write pidfile: %s", err)
+		return
+	}
+	recordedPID = pid
+	Verbose.Printf("Wrote PID %d to %s", pid, pidFile.Name())
+}
+
+// removePIDFile removes the locked pidfile, if any, when the daemon shuts
+// down.  It is left alone if it has been handed to a process which took over
+// from this one.
+func removePIDFile() {
+	if pidFile == nil {
+		return
+	}
+	defer func() {
+		pidFile.Close()
+		pidFile = nil
+	}()
+
+	if recordedPID != os.Getpid() {
+		return
+	}
+
+	// Another instance may have taken over the path (see ForcePIDFile)
+	ours, err := pidFile.Stat()
+	if err != nil {
+		Warning.Printf("Failed to stat pidfile: %s", err)
+		return
+	}
+	if current, err := os.Stat(pidFile.Name()); err != nil || !os.SameFile(ours, current) {
+		Verbose.Printf("Not removing pidfile %s: replaced by another process", pidFile.Name())
+		return
+	}
+	if err := os.Remove(pidFile.Name()); err != nil {
+		Warning.Printf("Failed to remove pidfile: %s", err)
+		return
+	}
+	Verbose.Printf("Removed pidfile %s", pidFile.Name())
+}
+
+// passPIDFile passes a copy of the locked pidfile, if any, on to cmd.  If
+// inPlace is set, the command is to be run with execInPlace.
+func passPIDFile(cmd *exec.Cmd, inPlace bool) {
+	if pidFile == nil {
+		return
+	}
+	f, err := dupFile(pidFile) // provided in OS-specific files
+	if err != nil {
+		Warning.Printf("Failed to pass on pidfile lock: %s", err)
+		return
+	}
+
+	fd := 3 + len(cmd.ExtraFiles)
+	if inPlace {
+		fd = int(f.Fd())
+	}
+	cmd.ExtraFiles = append(cmd.ExtraFiles, f)
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%d", PIDFileEnv, fd))
+}
@@ -0,0 +1,41 @@
+// +build windows
+
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"errors"
+	"os"
+	"strconv"
+)
+
+// lockFile doesn't lock f on windows; instead, it reports whether the given
+// pid, if any, belongs to a running process.
+func lockFile(f *os.File, pid string) error {
+	n, err := strconv.Atoi(pid)
+	if err != nil || n == os.Getpid() {
+		return nil
+	}
+	if p, err := os.FindProcess(n); err == nil {
+		p.Release()
+		return errLocked
+	}
+	return nil
+}
+
+func dupFile(f *os.File) (*os.File, error) {
+	return nil, errors.New("not supported on windows")
+}
@@ -0,0 +1,356 @@
+// +build windows
+
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+var (
+	modkernel32 = syscall.NewLazyDLL("kernel32.dll")
+	modadvapi32 = syscall.NewLazyDLL("advapi32.dll")
+
+	procCreateNamedPipeW    = modkernel32.NewProc("CreateNamedPipeW")
+	procConnectNamedPipe    = modkernel32.NewProc("ConnectNamedPipe")
+	procDisconnectNamedPipe = modkernel32.NewProc("DisconnectNamedPipe")
+	procLocalFree           = modkernel32.NewProc("LocalFree")
+	procConvertSDDL         = modadvapi32.NewProc("ConvertStringSecurityDescriptorToSecurityDescriptorW")
+)
+
+const (
+	pipeAccessDuplex          = 0x3
+	fileFlagFirstPipeInstance = 0x80000
+	pipeTypeByte              = 0x0
+	pipeUnlimitedInstances    = 255
+	pipeBufferSize            = 4096
+	sddlRevision1             = 1
+
+	errorPipeConnected syscall.Errno = 535
+)
+
+// A pipeAddr is the address of a named pipe.
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+// A pipeConn is a connected instance of a named pipe.
+type pipeConn struct {
+	*os.File
+	addr pipeAddr
+}
+
+func (c *pipeConn) LocalAddr() net.Addr  { return c.addr }
+func (c *pipeConn) RemoteAddr() net.Addr { return c.addr }
+
+func (c *pipeConn) Close() error {
+	procDisconnectNamedPipe.Call(c.Fd())
+	return c.File.Close()
+}
+
+// A pipeListener accepts connections on a named pipe.  It always keeps
+// one pipe instance available for the next client to connect to.
+type pipeListener struct {
+	addr pipeAddr
+	sa   *syscall.SecurityAttributes
+
+	mu     sync.Mutex
+	next   syscall.Handle // InvalidHandle after an interrupted Accept
+	closed bool
+
+	accepting   bool        // set while Accept waits for a client
+	interrupted bool        // set once the deadline has passed
+	deadline    *time.Timer // interrupts Accept at the deadline
+}
+
+func createPipe(path string, first bool, sa *syscall.SecurityAttributes) (syscall.Handle, error) {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return syscall.InvalidHandle, err
+	}
+	mode := uintptr(pipeAccessDuplex)
+	if first {
+		mode |= fileFlagFirstPipeInstance
+	}
+	r, _, err := procCreateNamedPipeW.Call(
+		uintptr(unsafe.Pointer(name)), mode, pipeTypeByte, pipeUnlimitedInstances,
+		pipeBufferSize, pipeBufferSize, 0, uintptr(unsafe.Pointer(sa)))
+	if h := syscall.Handle(r); h != syscall.InvalidHandle {
+		return h, nil
+	}
+	return syscall.InvalidHandle, &os.PathError{Op: "CreateNamedPipe", Path: path, Err: err}
+}
+
+// securityAttributes converts the SDDL string to security attributes for
+// a named pipe.  The returned attributes are never freed, as they are used
+// for every pipe instance for the lifetime of the listener.
+func securityAttributes(sddl string) (*syscall.SecurityAttributes, error) {
+	if sddl == "" {
+		return nil, nil
+	}
+	s, err := syscall.UTF16PtrFromString(sddl)
+	if err != nil {
+		return nil, err
+	}
+	var sd uintptr
+	r, _, err := procConvertSDDL.Call(uintptr(unsafe.Pointer(s)), sddlRevision1, uintptr(unsafe.Pointer(&sd)), 0)
+	if r == 0 {
+		return nil, fmt.Errorf("bad security descriptor %q: %s", sddl, err)
+	}
+	sa := &syscall.SecurityAttributes{
+		SecurityDescriptor: sd,
+	}
+	sa.Length = uint32(unsafe.Sizeof(*sa))
+	return sa, nil
+}
+
+// listenPipe creates a listener on the named pipe at path.  If first is set,
+// it fails if the pipe already exists.
+func listenPipe(path, sddl string, first bool) (*pipeListener, error) {
+	sa, err := securityAttributes(sddl)
+	if err != nil {
+		return nil, err
+	}
+	h, err := createPipe(path, first, sa)
+	if err != nil {
+		if sa != nil {
+			procLocalFree.Call(sa.SecurityDescriptor)
+		}
+		return nil, err
+	}
+	return &pipeListener{
+		addr: pipeAddr(path),
+		sa:   sa,
+		next: h,
+	}, nil
+}
+
+func (l *pipeListener) closedErr() error {
+	return &net.OpError{Op: "accept", Net: "pipe", Addr: l.addr, Err: net.ErrClosed}
+}
+
+func (l *pipeListener) timeoutErr() error {
+	return &net.OpError{Op: "accept", Net: "pipe", Addr: l.addr, Err: os.ErrDeadlineExceeded}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil, l.closedErr()
+	}
+	if l.interrupted {
+		l.mu.Unlock()
+		return nil, l.timeoutErr()
+	}
+	if l.next == syscall.InvalidHandle {
+		// The last instance was released when Accept was interrupted
+		next, err := createPipe(string(l.addr), false, l.sa)
+		if err != nil {
+			l.mu.Unlock()
+			return nil, err
+		}
+		l.next = next
+	}
+	h := l.next
+	l.accepting = true
+	l.mu.Unlock()
+
+	r, _, err := procConnectNamedPipe.Call(uintptr(h), 0)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.accepting = false
+	if l.closed {
+		// The connection was made by Close to unblock us.
+		syscall.CloseHandle(h)
+		return nil, l.closedErr()
+	}
+	if l.interrupted {
+		// The connection was made by interrupt to unblock us.  Release
+		// the instance, so that another process can take over the pipe.
+		syscall.CloseHandle(h)
+		l.next = syscall.InvalidHandle
+		return nil, l.timeoutErr()
+	}
+	if r == 0 && err != errorPipeConnected {
+		return nil, &net.OpError{Op: "accept", Net: "pipe", Addr: l.addr, Err: err}
+	}
+	next, err := createPipe(string(l.addr), false, l.sa)
+	if err != nil {
+		syscall.CloseHandle(h)
+		return nil, err
+	}
+	l.next = next
+	return &pipeConn{
+		File: os.NewFile(uintptr(h), string(l.addr)),
+		addr: l.addr,
+	}, nil
+}
+
+func (l *pipeListener) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return l.closedErr()
+	}
+	l.closed = true
+	l.mu.Unlock()
+
+	// ConnectNamedPipe can't be interrupted, so connect to the waiting
+	// instance to fall out of a pending Accept.
+	if f, err := os.OpenFile(string(l.addr), os.O_RDWR, 0); err == nil {
+		f.Close()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.deadline != nil {
+		l.deadline.Stop()
+	}
+	if l.next != syscall.InvalidHandle {
+		syscall.CloseHandle(l.next)
+	}
+	if l.sa != nil {
+		procLocalFree.Call(l.sa.SecurityDescriptor)
+		l.sa = nil
+	}
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return l.addr
+}
+
+// SetDeadline sets the deadline for Accept, after which (until the deadline
+// is cleared) it fails with a timeout, so that the listener can be stopped.
+func (l *pipeListener) SetDeadline(t time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.deadline != nil {
+		l.deadline.Stop()
+		l.deadline = nil
+	}
+	l.interrupted = false
+	if !t.IsZero() {
+		l.deadline = time.AfterFunc(time.Until(t), l.interrupt)
+	}
+	return nil
+}
+
+// interrupt causes Accept to fail with a timeout until the deadline is
+// cleared, and releases the waiting pipe instance.
+func (l *pipeListener) interrupt() {
+	l.mu.Lock()
+	if l.closed || l.interrupted {
+		l.mu.Unlock()
+		return
+	}
+	l.interrupted = true
+	if !l.accepting {
+		if l.next != syscall.InvalidHandle {
+			syscall.CloseHandle(l.next)
+			l.next = syscall.InvalidHandle
+		}
+		l.mu.Unlock()
+		return
+	}
+	l.mu.Unlock()
+
+	// As in Close, connect to the waiting instance to fall out of Accept
+	if f, err := os.OpenFile(string(l.addr), os.O_RDWR, 0); err == nil {
+		f.Close()
+	}
+}
+
+type pipeFlag struct {
+	flag, proto string
+	path        string
+	sddl        string
+	listener    *WaitListener
+
+	// setup is applied to the listener when it is created
+	setup []func(*WaitListener)
+}
+
+func (p *pipeFlag) Listen() (net.Listener, error) {
+	// A process started by Restart shares the pipe with its parent until
+	// the parent stops listening.
+	under, err := listenPipe(p.path, p.sddl, Generation() == 0)
+	if err != nil {
+		return nil, err
+	}
+	Verbose.Printf("Listening for %s on: %s (from pipe)", p.proto, under.Addr())
+	listener := NewWaitListener(under)
+	for _, fn := range p.setup {
+		fn(listener)
+	}
+	p.listener = listener
+	return listener, nil
+}
+
+func (p *pipeFlag) waitListener() *WaitListener {
+	return p.listener
+}
+
+func (p *pipeFlag) configure(fn func(*WaitListener)) {
+	p.setup = append(p.setup, fn)
+}
+
+func (p *pipeFlag) Addr() net.Addr {
+	if p.listener == nil {
+		return nil
+	}
+	return p.listener.Addr()
+}
+
+func (p *pipeFlag) String() string {
+	return p.path
+}
+
+func (p *pipeFlag) Set(s string) error {
+	if len(s) == 0 {
+		return fmt.Errorf("--%s requires an argument", p.flag)
+	}
+	p.path = s
+	return nil
+}
+
+// PipeFlag registers a flag, which, when set, causes the returned
+// Listenable to listen on the named pipe at the given path (which
+// should be of the form `\\.\pipe\name`).  If sddl is nonempty, it
+// is the security descriptor (in SDDL form) applied to the pipe;
+// otherwise the default security descriptor is used.  The given proto
+// is used to create the help text.
+//
+// PipeFlag is only available on windows.
+func PipeFlag(name, path, sddl, proto string) Listenable {
+	p := &pipeFlag{
+		flag:  name,
+		proto: proto,
+		path:  path,
+		sddl:  sddl,
+	}
+	FlagSet.Var(p, name, fmt.Sprintf("Named pipe on which to listen for %s", proto))
+	return p
+}
@@ -14,10 +14,6 @@
 
 package daemon
 
-import (
-	"flag"
-)
-
 // A Privileges stores the desired privileges of a process
 // and metadata after they have been dropped.
 //
@@ -43,6 +39,6 @@ func (p *Privileges) Drop() (dropped bool) {
 // object to drop to the given username.  Recommended default value is "nobody".
 func PrivilegesFlag(name, def string) *Privileges {
 	p := new(Privileges)
-	flag.StringVar(&p.Username, name, def, "User to whom to drop privileges (if set)")
+	FlagSet.StringVar(&p.Username, name, def, "User to whom to drop privileges (if set)")
 	return p
 }
@@ -0,0 +1,167 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// A RestartPolicy determines when a Supervisor restarts a Program which has
+// exited.
+type RestartPolicy int
+
+// Restart policies for Programs.
+const (
+	RestartOnFailure RestartPolicy = iota // if it exits with a nonzero status
+	RestartAlways                         // whenever it exits
+	RestartNever                          // never
+)
+
+// A Program is a command which a Supervisor runs and supervises alongside
+// (or instead of) its workers.  Unlike workers, programs are not passed the
+// supervisor's flags or listeners.  Everything they write to their standard
+// output and error is logged, prefixed with their name.
+type Program struct {
+	// Name identifies the program in the logs.
+	Name string
+
+	// Args holds the command and its arguments.
+	Args []string
+
+	// Env holds environment variables, in the form "key=value", which are
+	// set for the program in addition to those of the supervisor.
+	Env []string
+
+	// Dir is the working directory of the program.  If it is empty, the
+	// program runs in the supervisor's working directory.
+	Dir string
+
+	// Restart determines when the program is restarted after it exits.
+	// Restarts are subject to the supervisor's backoff and restart budget.
+	Restart RestartPolicy
+
+	// After names the programs which must be ready before this one is
+	// first started.  When the supervisor shuts down, this program is
+	// stopped before them.
+	After []string
+
+	// NotifyReady indicates that the program reports when it is ready with
+	// the same handshake as Restart (see Ready), as programs built with this
+	// package do.  Otherwise, it is considered ready once it has started.
+	NotifyReady bool
+}
+
+// outputDrainTimeout is how long the Supervisor waits, after a program exits,
+// for the rest of its output to be logged, in case its descendants still
+// hold the pipe open.
+const outputDrainTimeout = time.Second
+
+// startProgram starts p, with its output piped to the logs, and returns a
+// channel which is closed once all of its output has been logged.  If p
+// reports readiness, it also returns the pipe on which it does so.
+func (s *Supervisor) startProgram(p *Program) (cmd *exec.Cmd, ready *os.File, logged <-chan struct{}, err error) {
+	if len(p.Args) == 0 {
+		return nil, nil, nil, errors.New("no command")
+	}
+	cmd = exec.Command(p.Args[0], p.Args[1:]...)
+	cmd.Dir = p.Dir
+	cmd.Env = append(os.Environ(), p.Env...)
+	if s.ProcessGroup {
+		setProcessGroup(cmd) // provided in OS-specific files
+	}
+
+	var readyW *os.File
+	if p.NotifyReady {
+		if ready, readyW, err = os.Pipe(); err != nil {
+			return nil, nil, nil, err
+		}
+		defer readyW.Close()
+		cmd.ExtraFiles = []*os.File{readyW}
+		cmd.Env = append(cmd.Env, ReadyEnv+"=3")
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		ready.Close()
+		return nil, nil, nil, err
+	}
+	cmd.Stdout, cmd.Stderr = w, w
+	err = startCmd(cmd)
+	w.Close()
+	if err != nil {
+		r.Close()
+		ready.Close()
+		return nil, nil, nil, err
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		logLines(r, p.Name+": ")
+	}()
+	return cmd, ready, done, nil
+}
+
+// readReady reports whether the process reported that it was ready on r,
+// rather than exiting, and closes r.
+func readReady(r *os.File) bool {
+	defer r.Close()
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil {
+		return false
+	}
+	_, err = parseReady(line)
+	return err == nil
+}
+
+// ParseProcfile parses a Procfile, in which each line gives the name of a
+// program and the shell command which runs it, separated by a colon, such
+// as:
+//
+//	web: ./server --port=8080
+//	worker: ./queue-worker
+//
+// Blank lines and lines beginning with # are ignored.  The commands are run
+// with /bin/sh, so signals may need to be sent to their process groups (see
+// Supervisor.ProcessGroup) to reach all of the processes which they start.
+func ParseProcfile(r io.Reader) ([]*Program, error) {
+	var progs []*Program
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("procfile line %d: want name: command", n)
+		}
+		name, command := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		if command == "" {
+			return nil, fmt.Errorf("procfile line %d: no command for %s", n, name)
+		}
+		progs = append(progs, &Program{
+			Name: name,
+			Args: []string{"/bin/sh", "-c", command},
+		})
+	}
+	return progs, s.Err()
+}
@@ -0,0 +1,70 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"os/exec"
+	"sync"
+)
+
+// ReapZombies causes Run and Supervise to reap orphaned processes which
+// have exited, so that they don't accumulate as zombies.  It is useful if
+// the daemon is running as PID 1, such as in a container, to which orphans
+// are reparented.  It is supported on linux only.
+//
+// Processes started by this package (such as by Restart or a Supervisor)
+// are left to it to wait for, but those started by the program, with
+// os/exec for instance, may be reaped before their Wait returns, in which
+// case it fails.  For this reason, it is not set by default; a program
+// which runs as PID 1 and starts processes of its own should leave it unset
+// and run under an init process (such as tini) instead.
+var ReapZombies = false
+
+// Subreaper causes Run and Supervise to make the process a child subreaper,
+// so that orphaned descendants (such as processes started by the workers of
+// a Supervisor) are reparented to it rather than to PID 1, and to reap them.
+// It is supported on linux only.
+var Subreaper = false
+
+// startReaping makes the process a subreaper if Subreaper is set, and starts
+// reaping zombies if it or ReapZombies is set.
+func startReaping() {
+	if Subreaper {
+		if err := setSubreaper(); err != nil { // provided in OS-specific files
+			Warning.Printf("Failed to become a subreaper: %s", err)
+		}
+	}
+	if ReapZombies || Subreaper {
+		go reapZombies() // provided in OS-specific files
+	}
+}
+
+var (
+	childrenMu sync.Mutex       // held while reaping
+	children   = map[int]bool{} // started by this package
+)
+
+// startChild starts cmd and records that it was started by this package,
+// which will wait for it, so that it isn't reaped.  The lock is held
+// throughout, so that the child can't be reaped before it is recorded.
+func startChild(cmd *exec.Cmd) error {
+	childrenMu.Lock()
+	defer childrenMu.Unlock()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	children[cmd.Process.Pid] = true
+	return nil
+}
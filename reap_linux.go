@@ -0,0 +1,106 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// prSetChildSubreaper is the prctl option which makes a process a subreaper.
+const prSetChildSubreaper = 36
+
+func setSubreaper() error {
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetChildSubreaper, 1, 0); errno != 0 {
+		return errno
+	}
+	Verbose.Printf("Became a child subreaper")
+	return nil
+}
+
+// reapZombies reaps orphaned children of this process whenever a child exits,
+// and does not return.
+func reapZombies() {
+	exited := make(chan os.Signal, 1)
+	signal.Notify(exited, syscall.SIGCHLD)
+	for {
+		reapOrphans()
+		<-exited
+	}
+}
+
+// reapOrphans reaps the children of this process which have exited and were
+// not started by this package.
+func reapOrphans() {
+	// Hold the lock throughout, so that children started meanwhile are
+	// neither reaped nor forgotten.
+	childrenMu.Lock()
+	defer childrenMu.Unlock()
+
+	zombies, live := scanChildren()
+	for pid := range children {
+		if !live[pid] {
+			// It has been waited for, and its PID may be reused
+			delete(children, pid)
+		}
+	}
+	for _, pid := range zombies {
+		if children[pid] {
+			continue
+		}
+		var status syscall.WaitStatus
+		if wpid, err := syscall.Wait4(pid, &status, syscall.WNOHANG, nil); err == nil && wpid == pid {
+			Verbose.Printf("Reaped orphaned process %d (exit status %d)", pid, status.ExitStatus())
+		}
+	}
+}
+
+// scanChildren returns the PIDs of the children of this process which have
+// exited and not been waited for, and the set of all of its children.
+func scanChildren() (zombies []int, all map[int]bool) {
+	all = map[int]bool{}
+	dirs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		Warning.Printf("Failed to scan for zombies: %s", err)
+		return nil, all
+	}
+	self := os.Getpid()
+	for _, dir := range dirs {
+		pid, err := strconv.Atoi(dir.Name())
+		if err != nil {
+			continue
+		}
+		stat, err := ioutil.ReadFile("/proc/" + dir.Name() + "/stat")
+		if err != nil {
+			continue
+		}
+		// The fields after the command name, which is in parentheses, begin
+		// with the state and the parent PID.
+		i := strings.LastIndexByte(string(stat), ')')
+		fields := strings.Fields(string(stat[i+1:]))
+		if len(fields) < 2 || fields[1] != strconv.Itoa(self) {
+			continue
+		}
+		all[pid] = true
+		if fields[0] == "Z" {
+			zombies = append(zombies, pid)
+		}
+	}
+	return zombies, all
+}
@@ -0,0 +1,114 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// relistens tracks listeners replaced by Relisten whose connections are
+// still draining.
+var relistens sync.WaitGroup
+
+// Relisten replaces the listener of l, which must be a Listenable returned by
+// ListenFlag or UnixListenFlag on which Listen has been called, with a new
+// one, without restarting the process.  If addr is not empty, the flag is
+// first set to it, as if it had been given on the command line, so that the
+// listener can be moved to another address (such as after a configuration
+// change); otherwise, the new listener is bound to the same address.
+//
+// The old listener is closed, so that Accept on it returns an error, and the
+// caller should begin serving the returned listener in its place.  The old
+// listener's connections are drained in the background as Shutdown drains
+// them, waiting up to timeout (or the listener's DrainTimeout) for them to
+// close, and Shutdown and Restart wait for them too.  If the new listener
+// cannot be created, Relisten listens on the old address again, and returns
+// the error along with the restored listener, if any.
+//
+// Relisten must not be called while the daemon is shutting down or
+// restarting, and l should not be part of a ListenerGroup.
+func Relisten(l Listenable, addr string, timeout time.Duration) (net.Listener, error) {
+	lf, ok := l.(*listenFlag)
+	if !ok {
+		return nil, fmt.Errorf("cannot relisten %T", l)
+	}
+	if lf.listener == nil {
+		return nil, fmt.Errorf("--%s is not listening", lf.flag)
+	}
+	select {
+	case <-stopOnce:
+		defer func() { stopOnce <- true }()
+	default:
+		return nil, errors.New("cannot relisten during shutdown or restart")
+	}
+
+	// Rebind to the address which the old listener was bound to, such as
+	// one inherited from another process, or a port chosen by the system
+	old := lf.listener
+	if lf.mode == "fd" {
+		if err := lf.resolve(old.Addr().String()); err != nil {
+			return nil, err
+		}
+	} else if bound, ok := old.Addr().(*net.TCPAddr); ok && lf.laddr != nil {
+		laddr := *lf.laddr
+		laddr.Port = bound.Port
+		lf.laddr, lf.lastPort = &laddr, 0
+	}
+	prev := *lf
+	if addr != "" {
+		if err := lf.Set(addr); err != nil {
+			*lf = prev
+			return nil, err
+		}
+	}
+
+	// Close the old listener first, since the address is usually the same
+	if err := old.Close(); err != nil {
+		Warning.Printf("Failed to close listener %s: %s", old.Addr(), err)
+	}
+	lf.listener = nil
+	listener, err := lf.Listen()
+	if err != nil {
+		Error.Printf("Failed to relisten --%s on %s: %s", lf.flag, lf, err)
+		*lf = prev
+		lf.listener = nil
+		if restored, rerr := lf.Listen(); rerr == nil {
+			listener = restored
+		}
+	} else {
+		Info.Printf("Relistening --%s on %s", lf.flag, listener.Addr())
+	}
+
+	ports := NewListenerGroup()
+	ports.Add(old)
+	beginDrain(ports, timeout)
+	relistens.Add(1)
+	go func() {
+		defer relistens.Done()
+		if err := ports.drain(timeout); err != nil {
+			if ForceClose {
+				n := forceClose(ports)
+				Warning.Printf("Relisten drain timed out after %s; closed %d connection(s)", timeout, n)
+				return
+			}
+			Warning.Printf("Relisten drain timed out after %s: %d connection(s) still open", timeout, old.Stats().Open)
+		}
+	}()
+	return listener, err
+}
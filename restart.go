@@ -15,12 +15,17 @@
 package daemon
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -31,115 +36,647 @@ func init() {
 	stopOnce <- true
 }
 
-func copyFlags() (cmd *exec.Cmd, ports []*WaitListener) {
-	cmd = exec.Command(os.Args[0])
+// FlagSet is the FlagSet on which the flags registered by this package
+// (ListenFlag, ForkPIDFlags, LogLevelFlag, etc.) are defined, and which
+// Restart and Fork walk to determine the flags to pass on to the new
+// process.  It must be set before any of those flags are registered, and the
+// program must parse it before calling Run.
+var FlagSet = flag.CommandLine
+
+// FlagPrefix holds the arguments which Restart and Fork pass to the new
+// process before its flags, such as the name of the subcommand whose
+// FlagSet is in use.
+var FlagPrefix []string
+
+var excludedFlags = map[string]bool{}
+
+// ExcludeFlags marks the named flags so that they are not passed on to the
+// new process by Restart or Fork, such as one-shot flags (e.g. to migrate a
+// database) or secrets which should not persist on the command line.  The
+// new process sees their default values.
+func ExcludeFlags(names ...string) {
+	for _, name := range names {
+		excludedFlags[name] = true
+	}
+}
+
+// RewriteFlag, if set, is called by Restart and Fork with each flag which is
+// to be passed on to the new process, other than those which pass on file
+// descriptors (such as ListenFlags), along with its value.  It returns the
+// value to pass instead, and whether to pass the flag at all.
+var RewriteFlag func(f *flag.Flag, value string) (string, bool)
+
+// RewriteEnv, if set, is called by Restart and Fork with the environment of
+// this process, in the form returned by os.Environ, and returns the
+// environment for the new process.  It can be used to add, remove, or
+// override variables, such as to scrub credentials or drop variables which
+// should only be seen once.  The variables used by this package to
+// communicate with the new process (such as GenerationEnv) are added
+// afterward.
+var RewriteEnv func(env []string) []string
+
+// copyFlags returns a command which runs the given binary with the current
+// flags, passing on the file descriptors of the listeners, which are
+// returned so that they can be stopped or closed.  If inPlace is set, the
+// command is to be run with execInPlace, so the file descriptors keep their
+// current numbers, and state which is written by this process as the new
+// one reads it is not passed on.  If rebind is set, the new process binds
+// its own sockets for the TCP listeners which allow it (see ReusePort)
+// instead.
+func copyFlags(path string, inPlace, rebind bool) (cmd *exec.Cmd, ports *ListenerGroup, packets []net.PacketConn) {
+	cmd = exec.Command(path, FlagPrefix...)
+	ports = NewListenerGroup()
+
+	// pass passes the files for the named flag on to the cmd
+	var env []string
+	pass := func(name string, files ...*os.File) {
+		var fds []string
+		for _, f := range files {
+			// The extra files list doesn't include stdin/out/err
+			fd := 3 + len(cmd.ExtraFiles)
+			if inPlace {
+				fd = int(f.Fd())
+			}
+			cmd.ExtraFiles = append(cmd.ExtraFiles, f)
+
+			if InheritViaEnv {
+				env = append(env, fmt.Sprintf("%s:%d", name, fd))
+			} else {
+				fds = append(fds, fmt.Sprintf("&%d", fd))
+			}
+		}
+		if len(fds) > 0 {
+			cmd.Args = append(cmd.Args, fmt.Sprintf("--%s=%s", name, strings.Join(fds, ",")))
+		}
+	}
+
+	FlagSet.VisitAll(func(f *flag.Flag) {
+		if excludedFlags[f.Name] {
+			return
+		}
 
-	flag.VisitAll(func(f *flag.Flag) {
 		switch val := f.Value.(type) {
 		case *listenFlag:
 			if val.listener == nil {
 				// flag hasn't been listened yet, so just pass through
 				break
 			}
-
-			// The extra files list doesn't include stdin/out/err
-			fd := 3 + len(cmd.ExtraFiles)
-
-			// Add this flag to the cmd
-			cmd.Args = append(cmd.Args, fmt.Sprintf("--%s=&%d", f.Name, fd))
-			cmd.ExtraFiles = append(cmd.ExtraFiles, val.listener.File())
+			if rebind && val.reusable() {
+				cmd.Args = append(cmd.Args, fmt.Sprintf("--%s=%s", f.Name, val.boundAddr()))
+				ports.Add(val.listener)
+				ports.rebound = append(ports.rebound, val.listener)
+				return
+			}
+			pass(f.Name, val.listener.File())
 
 			// return the port so it can be closed
-			ports = append(ports, val.listener)
+			ports.Add(val.listener)
+			return
+		case *dualFlag:
+			if val.listener == nil {
+				break
+			}
+			pass(f.Name, val.files()...)
+			ports.Add(val.listener)
+			return
+		case *packetFlag:
+			if val.conn == nil {
+				// flag hasn't been listened yet, so just pass through
+				break
+			}
+			pass(f.Name, val.files(inPlace)...)
+			packets = append(packets, val.conn)
+			return
+		case *ticketFlag:
+			pass(f.Name, val.file())
+			return
+		case *stateFlag:
+			if !inPlace {
+				pass(f.Name, val.file())
+			}
+			return
+		case *handoffFlag:
+			if !inPlace {
+				pass(f.Name, val.file())
+			}
 			return
 		case *forkFlag:
 			// Don't pass fork on to subprocesses
 			return
+		case unpassableFlag:
+			// The new process listens anew, but this one must still stop
+			if w := val.waitListener(); w != nil {
+				ports.Add(w)
+			}
+		case *logFileFlag:
+			if logFile == os.Stderr || InheritViaEnv {
+				break
+			}
+			file, err := dupFile(logFile) // provided in OS-specific files
+			if err != nil {
+				Verbose.Printf("Not passing on log file: %s", err)
+				break
+			}
+			fd := 3 + len(cmd.ExtraFiles)
+			if inPlace {
+				fd = int(file.Fd())
+			}
+			cmd.ExtraFiles = append(cmd.ExtraFiles, file)
+			cmd.Args = append(cmd.Args, fmt.Sprintf("--%s=&%d:%s", f.Name, fd, logFile.Name()))
+			return
+		}
+		value := f.Value.String()
+		if RewriteFlag != nil {
+			var ok bool
+			if value, ok = RewriteFlag(f, value); !ok {
+				return
+			}
 		}
-		cmd.Args = append(cmd.Args, fmt.Sprintf("--%s=%s", f.Name, f.Value))
+		cmd.Args = append(cmd.Args, fmt.Sprintf("--%s=%s", f.Name, value))
 	})
+
+	// Pass on the positional arguments after the flags
+	if args := FlagSet.Args()[commandArgs:]; len(args) > 0 {
+		cmd.Args = append(cmd.Args, "--")
+		cmd.Args = append(cmd.Args, args...)
+	}
+
+	if RewriteEnv != nil {
+		cmd.Env = RewriteEnv(os.Environ())
+		if cmd.Env == nil {
+			cmd.Env = []string{}
+		}
+	}
+	if len(env) > 0 {
+		if cmd.Env == nil {
+			cmd.Env = os.Environ()
+		}
+		cmd.Env = append(cmd.Env, InheritEnv+"="+strings.Join(env, ","))
+	}
+	passCaptureOutput(cmd)
 	return
 }
 
-func spawn(cmd *exec.Cmd) {
+// GenerationEnv is the environment variable through which Restart passes
+// the new process its generation.
+const GenerationEnv = "DAEMON_GENERATION"
+
+var generation, _ = strconv.Atoi(os.Getenv(GenerationEnv))
+
+// Generation returns the number of times the daemon has been restarted: zero
+// for the original process, one for the process started by its Restart, and
+// so on.  A nonzero Generation indicates that the process was started by
+// Restart, and so may have inherited its listeners.
+func Generation() int {
+	return generation
+}
+
+// nextGeneration passes the generation after this one, and the Version of
+// this one, on to cmd.
+func nextGeneration(cmd *exec.Cmd) {
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%d", GenerationEnv, generation+1))
+	passVersion(cmd)
+}
+
+// closeFiles closes this process's copies of the files passed to cmd.
+func closeFiles(cmd *exec.Cmd) {
+	for _, f := range cmd.ExtraFiles {
+		f.Close()
+	}
+}
+
+// start starts cmd with the same standard output and error as this process
+// (see CaptureOutput).
+func start(cmd *exec.Cmd) error {
+	cmd.Stdout = childStdout
+	cmd.Stderr = childStderr
+	setProcAttr(cmd) // provided in OS-specific files
+	return startCmd(cmd)
+}
+
+// startCmd starts cmd as it is.
+func startCmd(cmd *exec.Cmd) error {
 	Verbose.Printf("Spawning process: %q %q", cmd.Args[0], cmd.Args[1:])
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Start(); err != nil {
-		Fatal.Printf("Exec failed: %s", err)
+	if err := startChild(cmd); err != nil {
+		return fmt.Errorf("exec failed: %s", err)
+	}
+	return nil
+}
+
+func spawn(cmd *exec.Cmd) {
+	if err := start(cmd); err != nil {
+		Fatal.Printf("%s", err)
 	}
 }
 
-// Restart re-execs the current process, passing all of the same flags,
-// except that ListenFlags will be replaced with "&fd" to copy the file
-// descriptor from this process.  Restart does not return.
+// Restart re-execs the current process, passing all of the same flags (and
+// positional arguments), except that ListenFlags and PacketFlags will be
+// replaced with "&fd" to copy the file descriptor from this process (or
+// passed in InheritEnv if InheritViaEnv is set).  If ReadyTimeout is set,
+// the process keeps serving until the new one is ready, and if HealthCheck
+// or WatchChild is set, it stands by while the new one is checked; if the
+// new process fails in the meantime, Restart returns and the process
+// continues serving.  Otherwise, Restart does not return.  As with Shutdown,
+// a zero timeout waits without limit for the connections to close.
+//
+// If RestartBinary is set, Restart runs that binary instead of the current
+// one; see RestartExec.
 func Restart(timeout time.Duration) {
-	<-stopOnce
-	close(Lamed)
+	RestartExec(restartBinary(), timeout)
+}
 
-	cmd, ports := copyFlags()
-	for _, w := range ports {
-		w.Stop()
-		// Send noop connections to free up the accept loops
-		w.noop()
+// restartBinary returns the path to the binary which Restart runs.
+func restartBinary() string {
+	if RestartBinary != "" {
+		return RestartBinary
 	}
-	spawn(cmd)
+	return os.Args[0]
+}
 
-	// Wait for all connections to close out
-	done := make(chan bool)
-	go func() {
-		defer close(done)
-		for _, w := range ports {
-			w.Wait()
-		}
-	}()
-	select {
-	case <-done:
-	case <-time.After(timeout):
+// absBinary returns the absolute path of the current binary as it was run,
+// so that the process started by Fork, which runs in ForkDir, can run it (and
+// Restart it) from there.
+func absBinary() string {
+	path, err := exec.LookPath(os.Args[0])
+	if err == nil {
+		path, err = filepath.Abs(path)
+	}
+	if err != nil {
+		Warning.Printf("Failed to find absolute path of %s: %s", os.Args[0], err)
+		return os.Args[0]
+	}
+	return path
+}
+
+// checkBinary checks that the binary at path exists and can be run, and
+// returns it open if it has been verified (see openBinary).
+func checkBinary(path string) (*os.File, error) {
+	path, err := exec.LookPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return openBinary(path)
+}
+
+// RestartBinary, if set, is the path to the binary which Restart runs in
+// place of the current one.  See UpgradeBinaryFlag.
+var RestartBinary string
+
+// UpgradeBinaryFlag registers a flag with the given name which sets
+// RestartBinary, so that the daemon can be upgraded to a binary installed
+// at another path.
+func UpgradeBinaryFlag(name string) {
+	FlagSet.StringVar(&RestartBinary, name, "", "Binary to run when restarting (default: the current binary)")
+}
+
+// RestartExec is like Restart, but runs the binary at the given path instead
+// of the current one, passing it the same flags and listeners.  This allows
+// a true upgrade to a newly installed binary.  If the binary cannot be
+// found or fails verification (see VerifyBinary), RestartExec logs an error
+// and returns without disturbing the current process.
+func RestartExec(path string, timeout time.Duration) {
+	err := restart(path, timeout)
+	if errors.Is(err, ErrTimeout) {
 		Fatal.Printf("Restart timed out after %s", timeout)
 	}
+	if err != nil {
+		Error.Printf("Restart failed; continuing to serve: %s", err)
+		return
+	}
 	Verbose.Printf("Restart complete")
-	os.Exit(0)
+	exitProcess(0)
 }
 
-// Shutdown closes all ListenFlags and waits for their connections to
-// finish.  Shutdown does not return.
-func Shutdown(timeout time.Duration) {
+// RestartWait is like Restart, but returns instead of exiting, so that the
+// caller can clean up other resources before it exits.  Once the new process
+// has taken over, RestartWait waits for connections to close and returns nil,
+// or ErrTimeout if they don't close within the timeout (unless ForceClose is
+// set, in which case they are closed).  Any other error
+// indicates that the restart failed and that the process continues serving.
+func RestartWait(timeout time.Duration) error {
+	return restart(restartBinary(), timeout)
+}
+
+func restart(path string, timeout time.Duration) error {
 	<-stopOnce
-	close(Lamed)
 
-	_, ports := copyFlags()
-	for _, w := range ports {
-		w.Close()
+	bin, err := checkBinary(path)
+	if err != nil {
+		stopOnce <- true
+		return err
+	}
+	if ExecInPlace {
+		return restartInPlace(path, bin, timeout)
 	}
 
-	// Wait for all connections to close out
-	done := make(chan bool)
-	go func() {
-		defer close(done)
-		for _, w := range ports {
-			w.Wait()
+	runHooks(&restartHooks, false)
+	cmd, ports, packets := copyFlags(path, false, ReusePort)
+	if err := runVerified(cmd, bin, false); err != nil { // provided in OS-specific files
+		closeFiles(cmd)
+		stopOnce <- true
+		return err
+	}
+	passPIDFile(cmd, false)
+	nextGeneration(cmd)
+	if ReadyTimeout > 0 || len(ports.rebound) > 0 {
+		// Keep serving until the new process is ready (and so has bound
+		// its own sockets, if it is to)
+		r, err := startReady(cmd)
+		if err != nil {
+			closeFiles(cmd)
+			stopOnce <- true
+			return err
 		}
-	}()
-	select {
-	case <-done:
-	case <-time.After(timeout):
+		if err := waitReady(cmd, r, ReadyTimeout); err != nil {
+			rollback(cmd)
+			return err
+		}
+		Info.Printf("New process %d is ready", cmd.Process.Pid)
+	} else if err := start(cmd); err != nil {
+		closeFiles(cmd)
+		stopOnce <- true
+		return err
+	}
+	recordPID(cmd.Process.Pid)
+	if (HealthCheck != nil || WatchChild > 0) && !ReusePort {
+		// Stop accepting, but stand by in case the new process fails
+		ports.pause()
+	}
+	if HealthCheck != nil {
+		if err := HealthCheck(); err != nil {
+			ports.resume()
+			rollback(cmd)
+			return err
+		}
+		Info.Printf("New process %d is healthy", cmd.Process.Pid)
+	}
+	if WatchChild > 0 {
+		if err := watchChild(cmd, WatchChild); err != nil {
+			ports.resume()
+			rollback(cmd)
+			return err
+		}
+	}
+
+	lameDuck()
+	ports.Stop()
+	ports.closeRebound()
+	beginDrain(ports, timeout)
+	closeFiles(cmd)
+
+	// The child now has its own copy of the packet sockets
+	for _, p := range packets {
+		p.Close()
+	}
+
+	// Wait for all connections to close out
+	err = ports.drain(timeout)
+	if err != nil && ForceClose {
+		n := forceClose(ports)
+		Warning.Printf("Restart timed out after %s; closed %d connection(s)", timeout, n)
+		err = nil
+	}
+	transfers.Wait()
+	relistens.Wait()
+	runHooks(&shutdownHooks, true)
+	return err
+}
+
+// ReusePort, if set, causes TCP listeners to be bound with SO_REUSEPORT, and
+// Restart to use a blue/green cutover for them: rather than inheriting their
+// sockets, the new process binds its own alongside them, so that both
+// processes accept connections until this one closes its sockets and
+// drains.  Restart always waits for the new process to report that it is
+// ready (see Ready) before doing so, indefinitely unless ReadyTimeout is
+// set, and also for it to be healthy, if HealthCheck is set, and for
+// WatchChild, during which this process keeps accepting.  Listeners which
+// are not bound by this process with the option, such as inherited ones,
+// are passed on as usual.  Since the connections which are waiting to be
+// accepted from this process's sockets when it closes them are reset, this
+// suits stateless services whose clients retry.  ReusePort must be set
+// before listening; it is supported on linux only.
+var ReusePort = false
+
+// ExecInPlace, if set, causes Restart to replace the current process with
+// the new one using exec, rather than starting a new process and exiting,
+// so that the daemon keeps the same PID.  This suits supervisors (such as
+// systemd or runit) which track the PID of the service.  Since only one
+// process can run, the listeners are stopped and connections drained before
+// the exec (connections which remain open when the timeout expires are
+// closed by it), and new connections wait in the listen queue meanwhile.
+// ReadyTimeout, HealthCheck, WatchChild, StateFlag, and ConnHandoffFlag have
+// no effect.  Restart returns an error if the binary can't be run, but once
+// the exec is attempted it does not return: if the exec fails, the process
+// has already stopped serving, so it exits with an error.  It is supported on
+// posix systems only.
+var ExecInPlace = false
+
+// restartInPlace restarts the process using execInPlace.  It does not
+// return; if the exec fails, the process exits.
+func restartInPlace(path string, bin *os.File, timeout time.Duration) error {
+	runHooks(&restartHooks, false)
+	cmd, ports, _ := copyFlags(path, true, false)
+	if err := runVerified(cmd, bin, true); err != nil {
+		closeFiles(cmd)
+		stopOnce <- true
+		return err
+	}
+	passPIDFile(cmd, true)
+	nextGeneration(cmd)
+
+	lameDuck()
+	ports.Stop()
+	beginDrain(ports, timeout)
+	if err := ports.drain(timeout); err != nil {
+		Warning.Printf("Restart timed out after %s; closing %d connection(s)", timeout, ports.Stats().Open)
+	}
+	runHooks(&shutdownHooks, true)
+	runExitHooks()
+
+	Verbose.Printf("Executing in place: %q %q", cmd.Args[0], cmd.Args[1:])
+	err := execInPlace(cmd)
+	// The listeners are stopped and the hooks have run, so there's no going back
+	Fatal.Printf("Exec failed: %s", err)
+	return err
+}
+
+// PreDrainDelay, if nonzero, causes Shutdown to keep accepting connections
+// for the given duration after the daemon enters lame duck mode (see Lamed),
+// before it closes its listeners and begins draining.  This gives load
+// balancers time to stop sending it new connections, such as while
+// Kubernetes removes a pod from its service's endpoints after sending it
+// SIGTERM; readiness checks should fail once InLameDuck returns true.
+var PreDrainDelay time.Duration
+
+// GracePeriod, if nonzero, limits the total time Shutdown takes, including
+// the PreDrainDelay, so that it finishes draining before the process would be
+// killed, such as at the end of a Kubernetes pod's termination grace period.
+// The drain timeouts are shortened as necessary to fit within it.  It should
+// be set somewhat shorter than the actual grace period, to leave time for the
+// OnShutdown hooks.
+var GracePeriod time.Duration
+
+// Shutdown closes all ListenFlags and PacketFlags and waits for their
+// connections to finish.  If timeout is zero, Shutdown waits without limit
+// for any listener without a DrainTimeout.  Shutdown does not return.
+func Shutdown(timeout time.Duration) {
+	if err := ShutdownWait(timeout); err != nil {
 		Fatal.Printf("Shutdown timed out after %s", timeout)
 	}
 	Info.Printf("Shutdown complete")
-	os.Exit(0)
+	exitProcess(0)
+}
+
+// ShutdownWait is like Shutdown, but returns instead of exiting, so that the
+// caller can clean up other resources before it exits.  It returns ErrTimeout
+// if the connections don't close within the timeout (unless ForceClose is
+// set, in which case they are closed).
+func ShutdownWait(timeout time.Duration) error {
+	<-stopOnce
+	start := time.Now()
+	notify("STOPPING=1")
+	lameDuck()
+
+	ports, packets := flagListeners()
+	if PreDrainDelay > 0 {
+		delay := PreDrainDelay
+		if GracePeriod > 0 && delay > GracePeriod {
+			delay = GracePeriod
+		}
+		Info.Printf("Accepting connections for %s before draining", delay)
+		time.Sleep(delay)
+	}
+	if GracePeriod > 0 {
+		ports.limitDrain(GracePeriod - time.Since(start))
+	}
+	ports.Close()
+	beginDrain(ports, timeout)
+	for _, p := range packets {
+		p.Close()
+	}
+
+	// Wait for all connections to close out
+	err := ports.drain(timeout)
+	if err != nil && ForceClose {
+		n := forceClose(ports)
+		Warning.Printf("Shutdown timed out after %s; closed %d connection(s)", time.Since(start).Round(time.Millisecond), n)
+		err = nil
+	}
+	relistens.Wait()
+	runHooks(&shutdownHooks, true)
+	if err == nil {
+		removePIDFile()
+	}
+	return err
+}
+
+// forceClose closes the connections which remain open on ports after
+// draining has timed out, logging each of them, and returns how many were
+// closed.
+func forceClose(ports *ListenerGroup) int {
+	var n int
+	for _, w := range ports.Listeners() {
+		for _, c := range w.Conns() {
+			Warning.Printf("Closing connection still open after %s: (local) %s <- %s (remote)",
+				time.Since(c.(*waitConn).accepted).Round(time.Second), c.LocalAddr(), c.RemoteAddr())
+			c.Close()
+			n++
+		}
+	}
+	return n
+}
+
+// flagListeners returns the listeners and packet sockets of the flags which
+// have been listened on.
+func flagListeners() (ports *ListenerGroup, packets []net.PacketConn) {
+	ports = NewListenerGroup()
+	FlagSet.VisitAll(func(f *flag.Flag) {
+		switch val := f.Value.(type) {
+		case *listenFlag:
+			if val.listener != nil {
+				ports.Add(val.listener)
+			}
+		case *dualFlag:
+			if val.listener != nil {
+				ports.Add(val.listener)
+			}
+		case *packetFlag:
+			if val.conn != nil {
+				packets = append(packets, val.conn)
+			}
+		case unpassableFlag:
+			if w := val.waitListener(); w != nil {
+				ports.Add(w)
+			}
+		}
+	})
+	return ports, packets
+}
+
+// An unpassableFlag is a listener flag, such as a PipeFlag, whose listener
+// can't be passed on to a new process, but which is stopped and drained like
+// the others.
+type unpassableFlag interface {
+	waitListener() *WaitListener
 }
 
 // A Forker knows how to duplicate the main process by replicating its flags.
 // Fork only returns in the subprocess.  The parent process exits, and the
-// child process writes its pid to the pidfile.
+// child process writes its pid to the pidfile.  The child runs as a daemon:
+// on posix systems, it is started in a new session, without a controlling
+// terminal, in ForkDir, with ForkUmask, and (optionally) by way of a
+// DoubleFork.  Its standard input is connected to the null device, and its
+// standard output and error are redirected as described by ForkOutput.
+// When Restart starts a new process, it writes the new process's pid to the
+// pidfile, and when Shutdown completes cleanly, it removes the pidfile.
+//
+// On posix systems, the pidfile is locked for as long as the daemon runs,
+// including across Restarts, and Fork exits without forking if another
+// instance of the daemon holds the lock.
+//
+// If AutoDetect is set and the process is managed by systemd or a container,
+// Fork does nothing: the process neither forks nor writes a pidfile.  Nor
+// does it in a Supervisor's worker processes, which are not passed the pidfile.
 type Forker interface {
 	Fork()
 }
 
+// A Commander interprets a control command (such as "stop") given on the
+// command line.  The Forker returned by ForkPIDFlags is also a Commander:
+//
+//	f := daemon.ForkPIDFlags("fork", "pidfile", "/var/run/food.pid")
+//	flag.Parse()
+//	f.(daemon.Commander).Command()
+//	f.Fork()
+type Commander interface {
+	Command()
+}
+
+// forkStageEnv is set in the intermediate process started by a DoubleFork.
+const forkStageEnv = "DAEMON_FORK_STAGE"
+
 type forkFlag struct {
 	fork    bool
 	pidfile string
+	output  *string // see ForkOutput
+}
+
+// outputFile returns the file to which the standard output and error of the
+// forked process are written, or nil for the null device.
+func (f *forkFlag) outputFile() (*os.File, error) {
+	if f.output == nil {
+		if logFile == os.Stderr {
+			return nil, nil
+		}
+		return logFile, nil
+	}
+	if *f.output == "" || *f.output == os.DevNull {
+		return nil, nil
+	}
+	return os.OpenFile(*f.output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
 }
 
 func (f *forkFlag) String() string {
@@ -156,6 +693,40 @@ func (f *forkFlag) Set(s string) error {
 }
 
 func (f *forkFlag) Fork() {
+	if Worker() > 0 {
+		// The Supervisor owns the pidfile
+		return
+	}
+	if m, ok := managed(); ok {
+		if f.fork {
+			Info.Printf("Not forking into the background: managed by %s", m)
+		}
+		return
+	}
+
+	if f.pidfile != "" && !filepath.IsAbs(f.pidfile) {
+		// The daemon runs in ForkDir, so it must be told where it is
+		if path, err := filepath.Abs(f.pidfile); err == nil {
+			f.pidfile = path
+		}
+	}
+	file, err := openPIDFile(f.pidfile)
+	if err != nil {
+		if errors.Is(err, errLocked) {
+			Error.Printf("Already running: %s", err)
+			os.Exit(1)
+		}
+		Error.Printf("Failed to open pidfile: %s", err)
+	}
+	pidFile = file
+
+	intermediate := os.Getenv(forkStageEnv) != ""
+	if intermediate {
+		// Fork again, as the first fork of a DoubleFork
+		os.Unsetenv(forkStageEnv)
+		f.fork = true
+	}
+
 	if f.fork {
 		<-stopOnce
 
@@ -163,77 +734,294 @@ func (f *forkFlag) Fork() {
 		f.fork = false
 
 		Verbose.Printf("Forking into the background")
-		cmd, _ := copyFlags()
-		spawn(cmd)
+		cmd, _, _ := copyFlags(absBinary(), false, false)
+		passPIDFile(cmd, false)
+		daemonize(cmd, !intermediate) // provided in OS-specific files
+		out, err := f.outputFile()
+		if err != nil {
+			Fatal.Printf("Failed to open output for forked process: %s", err)
+		}
+		if out != nil {
+			cmd.Stdout, cmd.Stderr = out, out
+		}
+		if DoubleFork && !intermediate {
+			if cmd.Env == nil {
+				cmd.Env = os.Environ()
+			}
+			cmd.Env = append(cmd.Env, forkStageEnv+"=1")
+		}
+		if err := startDaemon(cmd); err != nil { // provided in OS-specific files
+			Fatal.Printf("%s", err)
+		}
+		recordPID(cmd.Process.Pid)
+		if out != nil && out != logFile {
+			out.Close()
+		}
+		closeFiles(cmd)
+		transfers.Wait()
 		os.Exit(0)
 	}
 
-	pidfile, err := os.Create(f.pidfile)
-	if err != nil {
-		Error.Printf("Failed to create pidfile: %s", err)
-		return
-	}
-	defer pidfile.Close()
+	recordPID(os.Getpid())
+}
+
+// A ForkOption configures the Forker returned by ForkPIDFlags.
+type ForkOption func(*forkFlag)
 
-	fmt.Fprintf(pidfile, "%d\n", os.Getpid())
-	Verbose.Printf("Wrote PID to %s", f.pidfile)
+// ForkOutput causes the standard output and error of the forked process to be
+// appended to the file at path, or discarded if path is empty.  By default,
+// they are written to the LogFileFlag file, if any, or discarded otherwise.
+func ForkOutput(path string) ForkOption {
+	return func(f *forkFlag) {
+		f.output = &path
+	}
 }
 
 // ForkPIDFlags registers two flags, with the given names, and returns a Forker
-// which should be called to manage forking and writing the PID to file.
-func ForkPIDFlags(forkFlagName, pidFlagName string, defPIDFile string) Forker {
+// which should be called to manage forking and writing the PID to file.  The
+// Forker is also a Commander.
+func ForkPIDFlags(forkFlagName, pidFlagName string, defPIDFile string, opts ...ForkOption) Forker {
 	f := &forkFlag{}
-	flag.StringVar(&f.pidfile, pidFlagName, defPIDFile, "File to which to write PID")
-	flag.BoolVar(&f.fork, forkFlagName, false, "Fork into the background")
+	for _, opt := range opts {
+		opt(f)
+	}
+	FlagSet.StringVar(&f.pidfile, pidFlagName, defPIDFile, "File to which to write PID")
+	FlagSet.BoolVar(&f.fork, forkFlagName, false, "Fork into the background")
 	return f
 }
 
+// ForceClose, if set, causes Shutdown and Restart to forcibly close any
+// connections which are still open when their timeout expires, logging
+// each of them, and exit normally, rather than aborting.
+var ForceClose = false
+
+// DrainDeadline, if set, causes Shutdown and Restart to set a deadline on
+// all open connections when they begin waiting for them to close, so that
+// reads and writes which are still blocked when the timeout expires fail
+// and allow the connections to be closed.
+var DrainDeadline = false
+
+// DrainLogInterval specifies how often Shutdown and Restart log the number
+// of connections remaining on each listener while they wait for them to
+// close.  If it is zero, no progress is logged.
+var DrainLogInterval = 5 * time.Second
+
+// CloseIdle, if nonzero, causes Shutdown and Restart to immediately close
+// connections which have been idle for at least the given duration when
+// they begin waiting for connections to close, so that idle keep-alive
+// connections don't hold up the process for the whole timeout.
+var CloseIdle time.Duration
+
+// beginDrain prepares the connections on ports to be drained within the
+// given timeout according to DrainDeadline and CloseIdle.
+func beginDrain(ports *ListenerGroup, timeout time.Duration) {
+	if DrainDeadline {
+		ports.setDrainDeadline(timeout)
+	}
+	if CloseIdle > 0 {
+		if n := ports.CloseIdle(CloseIdle); n > 0 {
+			Info.Printf("Closed %d idle connection(s)", n)
+		}
+	}
+}
+
 // LameDuck specifies the duration of the lame duck mode after the
-// listener is closed before the binary exits.
+// listener is closed before the binary exits.  If it is zero, the binary
+// waits without limit for the connections to close.
 var LameDuck = 15 * time.Second
 
+// LameDuckFlag registers a flag with the given name which sets LameDuck,
+// so that the time Run allows for connections to close when shutting down
+// or restarting can be tuned without recompiling.
+func LameDuckFlag(name string) {
+	FlagSet.DurationVar(&LameDuck, name, LameDuck, "How long to wait for connections to close when shutting down or restarting (0 for no limit)")
+}
+
 // Lamed is a channel which will be closed when the daemon is instructed
-// to shut down via the Shutdown or Restart method.
+// to shut down via the Shutdown or Restart method and enters lame duck
+// mode.  (If the Restart waits for the new process to become ready, this
+// is once it has.)  Since it is closed, any number of goroutines may wait
+// on it.
 var Lamed = make(chan struct{})
 
-// Run is the last thing to call from main.  It does not return.
+// InLameDuck returns whether the daemon is in lame duck mode, that is,
+// whether Lamed has been closed.  While it is, handlers should finish
+// quickly and avoid starting new long-running work, such as long polls or
+// batch jobs, since the process will exit once its connections have closed.
+func InLameDuck() bool {
+	select {
+	case <-Lamed:
+		return true
+	default:
+		return false
+	}
+}
+
+var lamedCtx, cancelLamed = context.WithCancel(context.Background())
+
+// Context returns a context which is cancelled when Lamed is closed, so that
+// handlers and background goroutines can stop work using the usual context
+// plumbing when the daemon begins to shut down or restart.
+func Context() context.Context {
+	return lamedCtx
+}
+
+// RestartInterval is the minimum time between restarts triggered by signals
+// in Run, so that a flood of signals doesn't cause the daemon to restart in
+// a tight loop.  A restart signal received sooner after the process started
+// (or after its last restart attempt) is delayed until the interval has
+// passed, and further restart signals received in the meantime are ignored.
+var RestartInterval time.Duration
+
+var startTime = time.Now()
+
+// Run is the last thing to call from main.  It does not return.  Unless an
+// Upgrader has been created, Run first calls Ready to report to the previous
+// process, if any, that this one is ready.
 //
-// Run handles the following signals:
+// By default, Run handles the following signals (see HandleSignal):
 //   SIGINT    - Calls Shutdown
 //   SIGTERM   - Calls Shutdown
 //   SIGHUP    - Calls Restart
 //   SIGUSR1   - Dumps a stack trace to the logs
 //
+// To reload the configuration with the OnReload hooks rather than restart
+// on SIGHUP, for instance, call HandleSignal(syscall.SIGHUP, ActionReload).
+//
 // If another signal is received during Shutdown or Restart, the process
-// will terminate immediately.
+// will terminate immediately, unless it is a restart or reload signal,
+// which is ignored.  Restart signals are also subject to RestartInterval.
+// Run also restarts the daemon on a schedule if RestartEvery is set.
+//
+// If systemd has enabled its watchdog for the process, Run also sends it
+// keepalives (see WatchdogCheck).  If the process was started as a Windows
+// service, Run connects it to the service control manager (see ServiceFlags).
+// If ReapZombies or Subreaper is set, Run reaps orphaned processes.
 func Run() {
+	if !manualReady {
+		if err := Ready(); err != nil {
+			Warning.Printf("%s", err)
+		}
+	}
+	runService() // provided in OS-specific files
+	startReaping()
+	if interval := watchdogInterval(); interval > 0 {
+		go watchdog(interval)
+	}
+
 	incoming := make(chan os.Signal, 10)
-	signal.Notify(incoming, signals...)
-	for sig := range incoming {
+	signal.Notify(incoming, handledSignals()...)
+
+	lastRestart := startTime
+	var delayed <-chan time.Time // non-nil while a restart is delayed
+	scheduled := nextRestart(startTime)
+	for {
+		var sig os.Signal
+		select {
+		case sig = <-incoming:
+		case <-scheduled:
+			sig, scheduled = scheduledRestart{}, nextRestart(time.Now())
+		case <-delayed:
+			delayed, lastRestart = nil, time.Now()
+			go Restart(LameDuck)
+			continue
+		}
+		action := sigAction(sig)
+		if _, ok := sig.(scheduledRestart); ok {
+			action = ActionRestart
+		}
+
 		select {
 		case <-stopOnce:
 			stopOnce <- true
 		default:
+			if action == ActionRestart || action == ActionReload {
+				Info.Printf("Ignoring %s during shutdown or restart", sig)
+				continue
+			}
 			Fatal.Printf("Aborted by signal during shutdown")
 		}
 
-		switch sigAction(sig) {
-		case sigShutdown:
+		switch action {
+		case ActionShutdown:
 			go Shutdown(LameDuck)
-		case sigRestart:
+		case ActionRestart:
+			if delayed != nil {
+				Info.Printf("Ignoring %s: restart already pending", sig)
+				break
+			}
+			if wait := time.Until(lastRestart.Add(RestartInterval)); wait > 0 {
+				Info.Printf("Delaying restart for %s", wait.Round(time.Millisecond))
+				delayed = time.After(wait)
+				break
+			}
+			lastRestart = time.Now()
 			go Restart(LameDuck)
-		case sigStackDump:
+		case ActionStackDump:
 			V(-5).Printf("Stack dump:\n" + stack())
+		case ActionReload:
+			go Reload()
 		default:
 			Warning.Printf("Unknown signal: %s", sig)
 		}
 	}
 }
 
-// Return values for platform-specific sigAction
+// An Action is what Run does when it receives a signal.
+type Action int
+
+// Actions for HandleSignal.
 const (
-	sigUnknown = iota
-	sigShutdown
-	sigRestart
-	sigStackDump
+	ActionNone      Action = iota // not handled by Run
+	ActionShutdown                // calls Shutdown
+	ActionRestart                 // calls Restart
+	ActionStackDump               // dumps a stack trace to the logs
+	ActionReload                  // calls Reload
 )
+
+// HandleSignal sets the action which Run takes when it receives sig.  If
+// action is ActionNone, Run no longer handles sig.  HandleSignal must be
+// called before Run.
+func HandleSignal(sig os.Signal, action Action) {
+	if action == ActionNone {
+		delete(signalActions, sig)
+		return
+	}
+	signalActions[sig] = action // initialized in OS-specific files
+}
+
+// handledSignals returns the signals handled by Run.
+func handledSignals() []os.Signal {
+	var sigs []os.Signal
+	for sig := range signalActions {
+		sigs = append(sigs, sig)
+	}
+	return sigs
+}
+
+// sigAction returns the action which Run takes when it receives sig.
+func sigAction(sig os.Signal) Action {
+	return signalActions[sig]
+}
+
+// actionSignal returns a signal for which Run takes the given action, if
+// there is one.
+func actionSignal(action Action) (os.Signal, bool) {
+	if action == ActionShutdown && signalActions[defaultShutdownSignal] == action {
+		return defaultShutdownSignal, true
+	}
+	for sig, a := range signalActions {
+		if a == action {
+			return sig, true
+		}
+	}
+	return nil, false
+}
+
+// shutdownSignal returns a signal which causes a process to shut down.
+func shutdownSignal() os.Signal {
+	if sig, ok := actionSignal(ActionShutdown); ok {
+		return sig
+	}
+	return defaultShutdownSignal
+}
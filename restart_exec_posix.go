@@ -0,0 +1,56 @@
+// +build linux darwin
+
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// execInPlace replaces the current process with cmd, keeping the file
+// descriptors in cmd.ExtraFiles (at their current numbers) open.  It only
+// returns if the exec fails.
+func execInPlace(cmd *exec.Cmd) error {
+	for _, f := range cmd.ExtraFiles {
+		if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), syscall.F_SETFD, 0); errno != 0 {
+			return os.NewSyscallError("fcntl", errno)
+		}
+	}
+
+	// The pipes from CaptureStdout and CaptureOutput don't survive the exec
+	if childStdout != os.Stdout {
+		if err := syscall.Dup2(int(childStdout.Fd()), int(os.Stdout.Fd())); err != nil {
+			return os.NewSyscallError("dup2", err)
+		}
+	}
+	if childStderr != os.Stderr {
+		if err := syscall.Dup2(int(childStderr.Fd()), int(os.Stderr.Fd())); err != nil {
+			return os.NewSyscallError("dup2", err)
+		}
+	}
+
+	env := cmd.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	path, err := exec.LookPath(cmd.Path)
+	if err != nil {
+		return err
+	}
+	return syscall.Exec(path, cmd.Args, env)
+}
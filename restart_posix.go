@@ -18,24 +18,37 @@ package daemon
 
 import (
 	"os"
+	"os/exec"
 	"syscall"
 )
 
-var signals = []os.Signal{
-	syscall.SIGINT,
-	syscall.SIGTERM,
-	syscall.SIGHUP,
-	syscall.SIGUSR1,
-}
+// Setsid causes processes started by Restart and Fork to be started in a new
+// session, so that they are detached from the controlling terminal (and so
+// are not sent SIGHUP when it hangs up) and from this process's process
+// group.
+var Setsid = false
+
+// Setpgid causes processes started by Restart and Fork to be started in a new
+// process group, so that they don't receive signals sent to this process's
+// process group (such as SIGINT from the terminal).  It is implied by Setsid.
+var Setpgid = false
 
-func sigAction(sig os.Signal) int {
-	switch sig {
-	case syscall.SIGINT, syscall.SIGTERM:
-		return sigShutdown
-	case syscall.SIGHUP:
-		return sigRestart
-	case syscall.SIGUSR1:
-		return sigStackDump
+func setProcAttr(cmd *exec.Cmd) {
+	switch {
+	case Setsid:
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	case Setpgid:
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 	}
-	return sigUnknown
+}
+
+// defaultShutdownSignal is the signal preferably sent to a process to shut
+// it down.
+var defaultShutdownSignal os.Signal = syscall.SIGTERM
+
+var signalActions = map[os.Signal]Action{
+	syscall.SIGINT:  ActionShutdown,
+	syscall.SIGTERM: ActionShutdown,
+	syscall.SIGHUP:  ActionRestart,
+	syscall.SIGUSR1: ActionStackDump,
 }
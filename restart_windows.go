@@ -0,0 +1,47 @@
+// +build windows
+
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// Setsid has no effect on windows.
+var Setsid = false
+
+// Setpgid causes processes started by Restart and Fork to be started in a new
+// process group, so that they don't receive CTRL+C signals sent to this
+// process's process group.
+var Setpgid = false
+
+func setProcAttr(cmd *exec.Cmd) {
+	if Setpgid {
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP,
+		}
+	}
+}
+
+// defaultShutdownSignal is the signal preferably sent to a process to shut
+// it down.
+var defaultShutdownSignal = os.Interrupt
+
+var signalActions = map[os.Signal]Action{
+	os.Interrupt: ActionShutdown,
+}
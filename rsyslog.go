@@ -0,0 +1,122 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// RemoteSyslogSpool is how many log messages RemoteSyslog keeps while the
+// collector is unreachable.  Once it is full, the oldest messages are dropped.
+var RemoteSyslogSpool = 10000
+
+// RemoteSyslogTLS, if set, is the TLS configuration used by RemoteSyslog to
+// connect to a "tls" collector, such as to present a client certificate.
+// Otherwise, the collector is verified against the system roots.
+var RemoteSyslogTLS *tls.Config
+
+// RemoteSyslog causes log messages to be sent to the syslog collector at addr,
+// in the format of RFC 5424, over the given network: "udp", "tcp", or "tls"
+// (TCP and TLS use octet-counted framing, as in RFC 6587).  The facility and
+// tag (or the program name, if it is empty) are as for Syslog, as are the
+// severities.  Messages are sent in the background, in addition to being
+// written to standard error and the LogFileFlag file; while the collector is
+// unreachable, they are spooled (see RemoteSyslogSpool) and the connection is
+// retried with exponential backoff.  When the process exits, it waits up to a
+// second for the spooled messages to be sent.
+func RemoteSyslog(network, addr, facility, tag string) error {
+	fac, ok := syslogFacilities[facility]
+	if !ok {
+		return fmt.Errorf("unknown syslog facility %q", facility)
+	}
+	switch network {
+	case "udp", "tcp", "tls":
+	default:
+		return fmt.Errorf("unknown syslog network %q", network)
+	}
+	if tag == "" {
+		tag = filepath.Base(os.Args[0])
+	}
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "-"
+	}
+
+	// HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA
+	header := fmt.Sprintf("%s %s %d - -", host, tag, os.Getpid())
+	s := &shipper{
+		server: "syslog collector " + addr,
+		dial: func() (net.Conn, error) {
+			d := &net.Dialer{Timeout: 10 * time.Second}
+			if network == "tls" {
+				return tls.DialWithDialer(d, "tcp", addr, RemoteSyslogTLS)
+			}
+			return d.Dial(network, addr)
+		},
+		format: func(e *logEntry) []byte {
+			return []byte(fmt.Sprintf("<%d>1 %s %s %s", fac<<3|severity(e.level),
+				e.time.Format(jsonTimeFormat), header, withSource(e)))
+		},
+		write: func(conn net.Conn, msg []byte) error {
+			if network != "udp" {
+				// Octet-counted framing
+				msg = []byte(fmt.Sprintf("%d %s", len(msg), msg))
+			}
+			_, err := conn.Write(msg)
+			return err
+		},
+	}
+	s.start(RemoteSyslogSpool)
+	return nil
+}
+
+type remoteSyslogFlag struct {
+	value string
+}
+
+func (f *remoteSyslogFlag) String() string {
+	return f.value
+}
+
+func (f *remoteSyslogFlag) Set(s string) error {
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("bad syslog collector %q (want network://host:port[/facility[/tag]])", s)
+	}
+	facility, tag, _ := strings.Cut(strings.TrimPrefix(u.Path, "/"), "/")
+	if facility == "" {
+		facility = "daemon"
+	}
+	if err := RemoteSyslog(u.Scheme, u.Host, facility, tag); err != nil {
+		return err
+	}
+	f.value = s
+	return nil
+}
+
+// RemoteSyslogFlag registers a flag with the given name which, when set to a
+// URL of the form "network://host:port/facility/tag" (such as
+// "tls://logs.example.com:6514/local0/myapp"), calls RemoteSyslog with its
+// parts.  The facility defaults to "daemon" and the tag to the program name.
+func RemoteSyslogFlag(name string) {
+	FlagSet.Var(&remoteSyslogFlag{}, name, "Remote syslog collector (network://host:port/facility/tag) to which to send logs")
+}
@@ -0,0 +1,144 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+)
+
+// RestartEvery, if nonzero, causes Run to restart the daemon once it has
+// been running for the given duration, plus a random delay of up to
+// RestartJitter, and within the MaintenanceWindow, if set.  The restart is
+// handled like a restart signal.  Since the new process starts its own
+// schedule, this restarts the daemon periodically.
+var RestartEvery time.Duration
+
+// RestartJitter is the longest random delay added to RestartEvery, so that
+// a fleet of daemons started at the same time don't all restart at once.
+var RestartJitter time.Duration
+
+// RestartEveryFlag registers a flag with the given name which sets
+// RestartEvery.
+func RestartEveryFlag(name string) {
+	FlagSet.DurationVar(&RestartEvery, name, RestartEvery, "Restart after running for this long (0 to disable)")
+}
+
+// A Window is a daily span of time, such as a maintenance window, given by
+// its start and end as offsets from midnight in local time.  If its end is
+// before its start, it spans midnight.  A zero Window spans the whole day.
+type Window struct {
+	Start, End time.Duration
+}
+
+// MaintenanceWindow restricts scheduled restarts (see RestartEvery) to the
+// given time of day.  A restart which is due outside the window is delayed
+// until a random time within the next one, so that restarts are spread out
+// across it.
+var MaintenanceWindow Window
+
+// MaintenanceWindowFlag registers a flag with the given name which sets the
+// MaintenanceWindow, in the form "HH:MM-HH:MM" (e.g. "02:00-04:00").
+func MaintenanceWindowFlag(name string) {
+	FlagSet.Var(&MaintenanceWindow, name, "Time of day during which to make scheduled restarts (HH:MM-HH:MM)")
+}
+
+func (w *Window) String() string {
+	if *w == (Window{}) {
+		return ""
+	}
+	clock := func(d time.Duration) string {
+		return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+	}
+	return clock(w.Start) + "-" + clock(w.End)
+}
+
+func (w *Window) Set(s string) error {
+	if s == "" {
+		*w = Window{}
+		return nil
+	}
+	i := strings.Index(s, "-")
+	if i < 0 {
+		return fmt.Errorf("bad window %q: want HH:MM-HH:MM", s)
+	}
+	var times [2]time.Duration
+	for j, clock := range []string{s[:i], s[i+1:]} {
+		var h, m int
+		_, err := fmt.Sscanf(clock, "%d:%d", &h, &m)
+		times[j] = time.Duration(h)*time.Hour + time.Duration(m)*time.Minute
+		if err != nil || h < 0 || m < 0 || m > 59 || times[j] > 24*time.Hour {
+			return fmt.Errorf("bad time of day %q: want HH:MM", clock)
+		}
+	}
+	*w = Window{Start: times[0], End: times[1]}
+	return nil
+}
+
+// next returns the span of the earliest occurrence of the window which ends
+// after t, starting no earlier than t.
+func (w Window) next(t time.Time) (start, end time.Time) {
+	length := w.End - w.Start
+	if length <= 0 {
+		length += 24 * time.Hour
+	}
+	y, m, d := t.Date()
+	for day := -1; ; day++ {
+		start = time.Date(y, m, d+day, 0, 0, 0, 0, t.Location()).Add(w.Start)
+		if end = start.Add(length); end.After(t) {
+			break
+		}
+	}
+	if start.Before(t) {
+		start = t
+	}
+	return start, end
+}
+
+// nextRestart returns a channel which delivers the time of the next
+// scheduled restart after t, or nil if none are scheduled.
+func nextRestart(t time.Time) <-chan time.Time {
+	if RestartEvery <= 0 {
+		return nil
+	}
+	due := t.Add(RestartEvery + jitter(RestartJitter))
+	if MaintenanceWindow != (Window{}) {
+		if start, end := MaintenanceWindow.next(due); start.After(due) {
+			due = start.Add(jitter(end.Sub(start)))
+		}
+	}
+	Verbose.Printf("Next scheduled restart at %s", due.Format(time.RFC3339))
+	return time.After(time.Until(due))
+}
+
+// jitter returns a random duration less than max, or zero if max is zero.
+func jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+// scheduledRestart stands in for a restart signal when a scheduled restart
+// is due.
+type scheduledRestart struct{}
+
+func (scheduledRestart) String() string { return "scheduled restart" }
+func (scheduledRestart) Signal()        {}
+
+var _ os.Signal = scheduledRestart{}
@@ -0,0 +1,85 @@
+// +build linux
+
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// listenSCTP creates a one-to-one style SCTP listener.  Such sockets behave
+// like TCP stream sockets, so the resulting listener is a *net.TCPListener
+// whose file descriptor can be passed on to a restarted process as usual.
+// The control function is called before the socket is bound, as with
+// net.ListenConfig.
+func listenSCTP(netw string, laddr *net.TCPAddr, control func(network, address string, c syscall.RawConn) error) (net.Listener, error) {
+	family := syscall.AF_INET6
+	switch {
+	case netw == "sctp4":
+		family = syscall.AF_INET
+	case netw == "sctp6":
+	case laddr.IP != nil && laddr.IP.To4() != nil:
+		family = syscall.AF_INET
+	}
+
+	var sa syscall.Sockaddr
+	switch family {
+	case syscall.AF_INET:
+		sa4 := &syscall.SockaddrInet4{Port: laddr.Port}
+		if laddr.IP != nil {
+			copy(sa4.Addr[:], laddr.IP.To4())
+		}
+		sa = sa4
+	case syscall.AF_INET6:
+		sa6 := &syscall.SockaddrInet6{Port: laddr.Port}
+		if laddr.IP != nil {
+			copy(sa6.Addr[:], laddr.IP.To16())
+		}
+		sa = sa6
+	}
+
+	fd, err := syscall.Socket(family, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, syscall.IPPROTO_SCTP)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("sctp:%s", laddr))
+	defer f.Close()
+
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		return nil, os.NewSyscallError("setsockopt", err)
+	}
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	network := "tcp4"
+	if family == syscall.AF_INET6 {
+		network = "tcp6"
+	}
+	if err := control(network, laddr.String(), rc); err != nil {
+		return nil, err
+	}
+	if err := syscall.Bind(fd, sa); err != nil {
+		return nil, os.NewSyscallError("bind", err)
+	}
+	if err := syscall.Listen(fd, syscall.SOMAXCONN); err != nil {
+		return nil, os.NewSyscallError("listen", err)
+	}
+	return net.FileListener(f)
+}
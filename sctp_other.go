@@ -0,0 +1,28 @@
+// +build !linux
+
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"syscall"
+)
+
+func listenSCTP(netw string, laddr *net.TCPAddr, control func(network, address string, c syscall.RawConn) error) (net.Listener, error) {
+	return nil, fmt.Errorf("%s is not supported on %s", netw, runtime.GOOS)
+}
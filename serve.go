@@ -0,0 +1,53 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"errors"
+	"net"
+	"runtime/debug"
+)
+
+// Serve accepts connections on the listener and calls handler for each one
+// in its own goroutine, closing the connection when the handler returns.
+// A panic in a handler is logged (with its stack trace) and the connection
+// is closed, but the rest of the server is unaffected.
+//
+// Serve returns nil when the listener is stopped or closed, and otherwise
+// returns the first error from Accept.
+func (w *WaitListener) Serve(handler func(net.Conn)) error {
+	for {
+		conn, err := w.Accept()
+		if errors.Is(err, ErrStopped) {
+			Verbose.Printf("Serve loop exited: %s", w.Addr())
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		go serveConn(conn, handler)
+	}
+}
+
+func serveConn(conn net.Conn, handler func(net.Conn)) {
+	defer conn.Close()
+	defer func() {
+		if r := recover(); r != nil {
+			Error.Printf("Panic serving %s: %v\n%s", conn.RemoteAddr(), r, debug.Stack())
+		}
+	}()
+	handler(conn)
+}
@@ -0,0 +1,83 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ServiceName is the name under which ServiceFlags installs the program as a
+// Windows service.  It defaults to the name of the executable.
+var ServiceName = strings.TrimSuffix(filepath.Base(os.Args[0]), ".exe")
+
+// An Installer installs and removes the program as a service.
+type Installer interface {
+	// Install installs or removes the service, as requested by the flags,
+	// and exits.  If neither is requested, it returns.
+	Install()
+}
+
+type serviceFlags struct {
+	install, remove bool
+}
+
+// ServiceFlags registers two flags, with the given names, which install and
+// remove the program as a Windows service named ServiceName, and returns an
+// Installer which should be called after the flags are parsed to do so.  The
+// service is installed to start automatically, with the same flags as this
+// process other than these two, and ServiceName is registered as an event
+// source for EventLog.
+//
+// When the program runs as a service, Run reports its state to the service
+// control manager, and calls Shutdown when the service is stopped (or the
+// system shuts down) and Reload when its parameters change.  Since the
+// service control manager tracks the process which it started, services
+// should reload rather than Restart.
+func ServiceFlags(installFlagName, removeFlagName string) Installer {
+	s := &serviceFlags{}
+	FlagSet.BoolVar(&s.install, installFlagName, false, "Install as a service")
+	FlagSet.BoolVar(&s.remove, removeFlagName, false, "Remove the installed service")
+	ExcludeFlags(installFlagName, removeFlagName)
+	return s
+}
+
+func (s *serviceFlags) Install() {
+	switch {
+	case s.remove:
+		if err := removeService(ServiceName); err != nil { // provided in OS-specific files
+			Error.Printf("Failed to remove service %s: %s", ServiceName, err)
+			os.Exit(1)
+		}
+		Info.Printf("Removed service %s", ServiceName)
+	case s.install:
+		path, err := os.Executable()
+		if err != nil {
+			Error.Printf("Failed to find executable: %s", err)
+			os.Exit(1)
+		}
+		cmd, _, _ := copyFlags(path, false, false)
+		closeFiles(cmd)
+		if err := installService(ServiceName, path, cmd.Args[1:]); err != nil {
+			Error.Printf("Failed to install service %s: %s", ServiceName, err)
+			os.Exit(1)
+		}
+		Info.Printf("Installed service %s", ServiceName)
+	default:
+		return
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,34 @@
+// +build !windows
+
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func installService(name, path string, args []string) error {
+	return fmt.Errorf("services are not supported on %s", runtime.GOOS)
+}
+
+func removeService(name string) error {
+	return fmt.Errorf("services are not supported on %s", runtime.GOOS)
+}
+
+// runService does nothing, since the process can only run as a service on
+// windows.
+func runService() {}
@@ -0,0 +1,242 @@
+// +build windows
+
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+var (
+	procStartServiceCtrlDispatcherW = modadvapi32.NewProc("StartServiceCtrlDispatcherW")
+	procRegisterServiceCtrlHandlerW = modadvapi32.NewProc("RegisterServiceCtrlHandlerExW")
+	procSetServiceStatus            = modadvapi32.NewProc("SetServiceStatus")
+	procOpenSCManagerW              = modadvapi32.NewProc("OpenSCManagerW")
+	procCreateServiceW              = modadvapi32.NewProc("CreateServiceW")
+	procOpenServiceW                = modadvapi32.NewProc("OpenServiceW")
+	procDeleteService               = modadvapi32.NewProc("DeleteService")
+	procCloseServiceHandle          = modadvapi32.NewProc("CloseServiceHandle")
+)
+
+const (
+	scManagerAllAccess = 0xf003f
+	serviceAllAccess   = 0xf01ff
+	serviceDelete      = 0x10000
+
+	serviceWin32OwnProcess = 0x10
+	serviceAutoStart       = 2
+	serviceErrorNormal     = 1
+
+	serviceStopped     = 1
+	serviceStopPending = 3
+	serviceRunning     = 4
+
+	serviceAcceptStop        = 0x1
+	serviceAcceptShutdown    = 0x4
+	serviceAcceptParamChange = 0x8
+
+	serviceControlStop        = 1
+	serviceControlInterrogate = 4
+	serviceControlShutdown    = 5
+	serviceControlParamChange = 6
+
+	errorCallNotImplemented             = 120
+	errorFailedServiceControllerConnect = 1063
+)
+
+// A serviceStatus is a SERVICE_STATUS.
+type serviceStatus struct {
+	serviceType             uint32
+	currentState            uint32
+	controlsAccepted        uint32
+	win32ExitCode           uint32
+	serviceSpecificExitCode uint32
+	checkPoint              uint32
+	waitHint                uint32
+}
+
+// A serviceTableEntry is a SERVICE_TABLE_ENTRYW.
+type serviceTableEntry struct {
+	name *uint16
+	proc uintptr
+}
+
+var (
+	serviceMu     sync.Mutex
+	serviceHandle uintptr
+	service       = serviceStatus{serviceType: serviceWin32OwnProcess}
+)
+
+// setServiceState reports the state of the service to the service control
+// manager, with a hint of how long it will take to change, if it is pending.
+func setServiceState(state uint32, wait time.Duration) {
+	serviceMu.Lock()
+	defer serviceMu.Unlock()
+
+	if service.currentState == serviceStopped {
+		return
+	}
+	service.currentState = state
+	service.waitHint = uint32(wait / time.Millisecond)
+	service.controlsAccepted = 0
+	if state == serviceRunning {
+		service.controlsAccepted = serviceAcceptStop | serviceAcceptShutdown | serviceAcceptParamChange
+	}
+	if state == serviceStopPending {
+		service.checkPoint++
+	}
+	reportService()
+}
+
+// reportService reports the current status of the service.  It must be
+// called with serviceMu held.
+func reportService() {
+	if r, _, err := procSetServiceStatus.Call(serviceHandle, uintptr(unsafe.Pointer(&service))); r == 0 {
+		Warning.Printf("Failed to report service status: %s", err)
+	}
+}
+
+var (
+	serviceMainCallback    = syscall.NewCallback(serviceMain)
+	serviceHandlerCallback = syscall.NewCallback(serviceHandler)
+)
+
+// serviceMain is the ServiceMain function of the service, called by the
+// service control dispatcher once it has connected to the service control
+// manager.
+func serviceMain(argc, argv uintptr) uintptr {
+	name, _ := syscall.UTF16PtrFromString(ServiceName)
+	h, _, err := procRegisterServiceCtrlHandlerW.Call(uintptr(unsafe.Pointer(name)), serviceHandlerCallback, 0)
+	if h == 0 {
+		Error.Printf("Failed to register service control handler: %s", err)
+		return 0
+	}
+
+	serviceMu.Lock()
+	serviceHandle = h
+	service.currentState = serviceRunning
+	service.controlsAccepted = serviceAcceptStop | serviceAcceptShutdown | serviceAcceptParamChange
+	reportService()
+	serviceMu.Unlock()
+	Info.Printf("Running as service %s", ServiceName)
+
+	OnLameDuck(func() {
+		setServiceState(serviceStopPending, LameDuck+GracePeriod)
+	})
+	OnShutdown(func() {
+		setServiceState(serviceStopped, 0)
+	})
+	return 0
+}
+
+// serviceHandler is the HandlerEx function of the service, which receives its
+// control codes.
+func serviceHandler(control, eventType, eventData, context uintptr) uintptr {
+	switch control {
+	case serviceControlStop, serviceControlShutdown:
+		Info.Printf("Service stopping")
+		setServiceState(serviceStopPending, LameDuck+GracePeriod)
+		go Shutdown(LameDuck)
+	case serviceControlParamChange:
+		go Reload()
+	case serviceControlInterrogate:
+		serviceMu.Lock()
+		reportService()
+		serviceMu.Unlock()
+	default:
+		return errorCallNotImplemented
+	}
+	return 0
+}
+
+// runService connects the process to the service control manager, if it was
+// started as a service.
+func runService() {
+	table := []serviceTableEntry{
+		{name: new(uint16), proc: serviceMainCallback},
+		{},
+	}
+	go func() {
+		// This blocks until the service has stopped.
+		r, _, err := procStartServiceCtrlDispatcherW.Call(uintptr(unsafe.Pointer(&table[0])))
+		if r == 0 && err != syscall.Errno(errorFailedServiceControllerConnect) {
+			Warning.Printf("Failed to connect to service control manager: %s", err)
+		}
+	}()
+}
+
+func installService(name, path string, args []string) error {
+	scm, _, err := procOpenSCManagerW.Call(0, 0, scManagerAllAccess)
+	if scm == 0 {
+		return err
+	}
+	defer procCloseServiceHandle.Call(scm)
+
+	cmdline := []string{syscall.EscapeArg(path)}
+	for _, arg := range args {
+		cmdline = append(cmdline, syscall.EscapeArg(arg))
+	}
+	namep, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return err
+	}
+	pathp, err := syscall.UTF16PtrFromString(strings.Join(cmdline, " "))
+	if err != nil {
+		return err
+	}
+	h, _, err := procCreateServiceW.Call(scm,
+		uintptr(unsafe.Pointer(namep)), uintptr(unsafe.Pointer(namep)),
+		serviceAllAccess, serviceWin32OwnProcess, serviceAutoStart, serviceErrorNormal,
+		uintptr(unsafe.Pointer(pathp)), 0, 0, 0, 0, 0)
+	if h == 0 {
+		return err
+	}
+	procCloseServiceHandle.Call(h)
+	if err := registerEventSource(name); err != nil {
+		Warning.Printf("Failed to register event source %s: %s", name, err)
+	}
+	return nil
+}
+
+func removeService(name string) error {
+	scm, _, err := procOpenSCManagerW.Call(0, 0, scManagerAllAccess)
+	if scm == 0 {
+		return err
+	}
+	defer procCloseServiceHandle.Call(scm)
+
+	namep, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return err
+	}
+	h, _, err := procOpenServiceW.Call(scm, uintptr(unsafe.Pointer(namep)), serviceDelete)
+	if h == 0 {
+		return err
+	}
+	defer procCloseServiceHandle.Call(h)
+
+	if r, _, err := procDeleteService.Call(h); r == 0 {
+		return err
+	}
+	if err := removeEventSource(name); err != nil {
+		Verbose.Printf("Failed to remove event source %s: %s", name, err)
+	}
+	return nil
+}
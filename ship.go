@@ -0,0 +1,127 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Reconnection delays for shippers, which double the delay after each failed
+// attempt.
+const (
+	minShipRedial = 100 * time.Millisecond
+	maxShipRedial = 30 * time.Second
+)
+
+// A shipper sends log messages to a remote server (such as a syslog
+// collector) in the background, spooling them while the server is
+// unreachable and reconnecting with exponential backoff.
+type shipper struct {
+	unsent, dropped int64 // accessed atomically; first for alignment
+
+	// server describes the server in log messages, such as
+	// "syslog collector 10.0.0.1:514".
+	server string
+
+	dial   func() (net.Conn, error)
+	format func(e *logEntry) []byte
+	write  func(conn net.Conn, msg []byte) error
+
+	spool chan []byte
+}
+
+// start starts sending log messages, keeping up to spool of them while the
+// server is unreachable.  When the process exits, it waits up to a second for
+// the spooled messages to be sent.
+func (s *shipper) start(spool int) {
+	s.spool = make(chan []byte, spool)
+	go s.run()
+	addLogSink(logSink{write: s.enqueue})
+	AtExit(func() { s.flush(time.Second) })
+}
+
+// enqueue formats e and adds it to the spool, dropping the oldest message if
+// the spool is full.
+func (s *shipper) enqueue(e *logEntry) {
+	msg := s.format(e)
+	atomic.AddInt64(&s.unsent, 1)
+	for {
+		select {
+		case s.spool <- msg:
+			return
+		default:
+		}
+		select {
+		case <-s.spool:
+			atomic.AddInt64(&s.unsent, -1)
+			atomic.AddInt64(&s.dropped, 1)
+		default:
+		}
+	}
+}
+
+// run sends spooled messages to the server, reconnecting as necessary.
+func (s *shipper) run() {
+	var conn net.Conn
+	var msg []byte // the next message to send
+	delay, down := minShipRedial, false
+	for {
+		if msg == nil {
+			msg = <-s.spool
+		}
+		if conn == nil {
+			c, err := s.dial()
+			if err != nil {
+				if !down {
+					Warning.Printf("Failed to connect to %s: %s", s.server, err)
+					down = true
+				}
+				time.Sleep(delay)
+				if delay *= 2; delay > maxShipRedial {
+					delay = maxShipRedial
+				}
+				continue
+			}
+			conn, delay = c, minShipRedial
+			if down {
+				Info.Printf("Connected to %s", s.server)
+				down = false
+			}
+			if n := atomic.SwapInt64(&s.dropped, 0); n > 0 {
+				Warning.Printf("Dropped %d log message(s) while %s was unreachable", n, s.server)
+			}
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if err := s.write(conn, msg); err != nil {
+			Warning.Printf("Lost connection to %s: %s", s.server, err)
+			conn.Close()
+			conn, down = nil, true
+			continue
+		}
+		msg = nil
+		atomic.AddInt64(&s.unsent, -1)
+	}
+}
+
+// flush waits up to timeout for the spooled messages to be sent.
+func (s *shipper) flush(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt64(&s.unsent) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,157 @@
+// +build go1.21
+
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// SetSlogHandler causes messages logged by this package's Loggers (and the
+// output of programs run by a Supervisor) to be passed to h instead of being
+// written to the log, so that an application which uses log/slog has a single
+// stream of logs.  Messages are still subject to LogLevel.  Error (as well as
+// Fatal and Exit) becomes slog.LevelError, Warning slog.LevelWarn, Info (and
+// the output of programs) slog.LevelInfo, and Verbose slog.LevelDebug, with
+// each higher V level one lower than that.
+//
+// It should be called before anything is logged.  If h is nil, messages are
+// written to the log again.
+func SetSlogHandler(h slog.Handler) {
+	if h == nil {
+		delegate = nil
+		return
+	}
+	delegate = func(t time.Time, pc uintptr, l Logger, msg string) {
+		ctx := context.Background()
+		level := slogLevel(l)
+		if !h.Enabled(ctx, level) {
+			return
+		}
+		if err := h.Handle(ctx, slog.NewRecord(t, level, msg, pc)); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to log to slog handler: %s\n", err)
+		}
+	}
+}
+
+// slogLevel returns the slog level corresponding to l.
+func slogLevel(l Logger) slog.Level {
+	switch {
+	case l == noLevel:
+		return slog.LevelInfo
+	case l <= Error:
+		return slog.LevelError
+	case l == Warning:
+		return slog.LevelWarn
+	case l == Info:
+		return slog.LevelInfo
+	}
+	return slog.LevelDebug - slog.Level(l-Verbose)
+}
+
+// loggerFor returns the Logger corresponding to the slog level, the inverse
+// of slogLevel.
+func loggerFor(level slog.Level) Logger {
+	switch {
+	case level >= slog.LevelError:
+		return Error
+	case level >= slog.LevelWarn:
+		return Warning
+	case level >= slog.LevelInfo:
+		return Info
+	case level >= slog.LevelDebug:
+		return Verbose
+	}
+	return Verbose + Logger(slog.LevelDebug-level)
+}
+
+// SlogHandler returns a slog.Handler which writes records to the log as this
+// package's Loggers do, subject to LogLevel, so that libraries which log with
+// log/slog are part of the daemon's logs.  Levels correspond as described for
+// SetSlogHandler, and attributes are appended to the message as key=value
+// pairs.  Records are never passed to the handler set by SetSlogHandler.
+func SlogHandler() slog.Handler {
+	return &slogHandler{}
+}
+
+type slogHandler struct {
+	attrs  string // formatted attributes added with WithAttrs
+	prefix string // prefix for keys, from WithGroup
+}
+
+func (h *slogHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return loggerFor(level) <= LogLevel
+}
+
+func (h *slogHandler) Handle(_ context.Context, r slog.Record) error {
+	var msg strings.Builder
+	msg.WriteString(r.Message)
+	msg.WriteString(h.attrs)
+	r.Attrs(func(a slog.Attr) bool {
+		appendAttr(&msg, h.prefix, a)
+		return true
+	})
+	t := r.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	writeEntry(t, r.PC, loggerFor(r.Level), msg.String())
+	return nil
+}
+
+func (h *slogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var b strings.Builder
+	b.WriteString(h.attrs)
+	for _, a := range attrs {
+		appendAttr(&b, h.prefix, a)
+	}
+	return &slogHandler{attrs: b.String(), prefix: h.prefix}
+}
+
+func (h *slogHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return &slogHandler{attrs: h.attrs, prefix: h.prefix + name + "."}
+}
+
+// appendAttr appends a to b as " key=value", with the key prefixed by the
+// names of its groups, quoting the value if it contains spaces or quotes.
+func appendAttr(b *strings.Builder, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, ga := range a.Value.Group() {
+			appendAttr(b, prefix, ga)
+		}
+		return
+	}
+	val := a.Value.String()
+	if val == "" || strings.ContainsAny(val, " \t\n\"=") {
+		val = fmt.Sprintf("%q", val)
+	}
+	fmt.Fprintf(b, " %s%s=%s", prefix, a.Key, val)
+}
@@ -0,0 +1,177 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// SocketOptions specifies options which are applied to a listening socket
+// before it is bound.  Requesting an option which is not supported on the
+// current platform causes Listen to fail.
+type SocketOptions struct {
+	// FreeBind allows the socket to be bound to an address which is not
+	// (yet) configured on the host, such as a virtual IP which will be
+	// assigned on failover (IP_FREEBIND on linux).
+	FreeBind bool
+
+	// FastOpen, if nonzero, enables TCP Fast Open on the socket with the
+	// given maximum number of pending fast open requests (TCP_FASTOPEN on
+	// linux).  Since the option is part of the socket, it is preserved when
+	// the socket is passed on by Restart.
+	FastOpen int
+
+	// Transparent allows the socket to accept connections addressed to
+	// any address, for use as a transparent proxy with TPROXY (IP_TRANSPARENT
+	// on linux).  See OriginalDst.
+	Transparent bool
+}
+
+// SetSocketOptions sets the options for the socket that l will create when
+// it Listens.  It must be called before Listen.  Sockets inherited from a
+// previous process retain the options with which they were created.
+func SetSocketOptions(l Listenable, opts SocketOptions) {
+	switch f := l.(type) {
+	case *listenFlag:
+		f.sockopts = opts
+	case *dualFlag:
+		f.v4.sockopts, f.v6.sockopts = opts, opts
+	default:
+		Fatal.Printf("cannot set socket options for %T", l)
+	}
+}
+
+func boolint(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// control sets the socket options for the flag's listener on the socket
+// before it is bound.  The network is the one chosen for the socket
+// itself (e.g. "tcp4" or "tcp6"), even for SCTP sockets.
+func (l *listenFlag) control(network, address string, c syscall.RawConn) error {
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		if network == "tcp6" {
+			// Be explicit, so that the result doesn't depend on the
+			// system's default (net.ipv6.bindv6only on linux).
+			v6only := l.net == "tcp6" || l.net == "sctp6"
+			err = setsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, boolint(v6only))
+			if err != nil {
+				return
+			}
+		}
+		if l.device != "" {
+			if err = bindToDevice(fd, l.device); err != nil {
+				return
+			}
+		}
+		if l.sockopts.FreeBind {
+			if err = freeBind(fd); err != nil {
+				return
+			}
+		}
+		if l.sockopts.Transparent {
+			if err = transparent(fd, network == "tcp6"); err != nil {
+				return
+			}
+		}
+		if l.sockopts.FastOpen > 0 && l.mode == "tcp" {
+			if err = fastOpen(fd, l.sockopts.FastOpen); err != nil {
+				return
+			}
+		}
+		if ReusePort && l.mode == "tcp" {
+			if err = reusePort(fd); err != nil {
+				return
+			}
+			l.reuseport = true
+		}
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// reusable returns whether the listener was bound with SO_REUSEPORT, so that
+// another process can bind the same address alongside it.
+func (l *listenFlag) reusable() bool {
+	return l.reuseport && l.listener != nil
+}
+
+// boundAddr returns the address to which the listener is bound, in the form
+// accepted by the flag, so that another process can bind it.
+func (l *listenFlag) boundAddr() string {
+	addr := l.listener.Addr().String()
+	if l.net != l.defNet {
+		addr = l.net + ":" + addr
+	}
+	if l.device != "" {
+		addr += "@" + l.device
+	}
+	return addr
+}
+
+// LingerFlag registers a flag with the given name which sets the linger
+// behavior of connections accepted from l.  See WaitListener.Linger.
+func LingerFlag(l Listenable, name string) {
+	c, ok := l.(configurable)
+	if !ok {
+		Fatal.Printf("cannot configure linger for %T", l)
+	}
+
+	linger := FlagSet.Int(name, -1, "Seconds to linger on close (0 to reset connections, -1 for system default)")
+	c.configure(func(w *WaitListener) {
+		w.Linger = *linger
+	})
+}
+
+// OriginalDst returns the address to which the client originally addressed
+// the connection, for use in transparent proxies.  For connections which
+// were redirected by netfilter (e.g. with REDIRECT), this is retrieved with
+// SO_ORIGINAL_DST; otherwise, such as for connections accepted on a socket
+// with the Transparent option using TPROXY, it is the local address.
+func OriginalDst(conn net.Conn) (net.Addr, error) {
+	laddr, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("no original destination for %s connection", conn.LocalAddr().Network())
+	}
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return laddr, nil
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var dst *net.TCPAddr
+	cerr := rc.Control(func(fd uintptr) {
+		dst, err = originalDst(fd, laddr.IP.To4() == nil)
+	})
+	if cerr != nil {
+		return nil, cerr
+	}
+	if err != nil {
+		// Not redirected, so the local address is the destination
+		return laddr, nil
+	}
+	return dst, nil
+}
@@ -0,0 +1,83 @@
+// +build linux
+
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Socket options not defined by package syscall
+const (
+	tcpFastOpen     = 0x17 // TCP_FASTOPEN
+	ipv6Transparent = 0x4b // IPV6_TRANSPARENT
+	soOriginalDst   = 0x50 // SO_ORIGINAL_DST
+	soReusePort     = 0xf  // SO_REUSEPORT
+)
+
+func bindToDevice(fd uintptr, device string) error {
+	return os.NewSyscallError("setsockopt", syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, device))
+}
+
+func freeBind(fd uintptr) error {
+	return setsockoptInt(fd, syscall.SOL_IP, syscall.IP_FREEBIND, 1)
+}
+
+func fastOpen(fd uintptr, qlen int) error {
+	return setsockoptInt(fd, syscall.IPPROTO_TCP, tcpFastOpen, qlen)
+}
+
+func reusePort(fd uintptr) error {
+	return setsockoptInt(fd, syscall.SOL_SOCKET, soReusePort, 1)
+}
+
+func transparent(fd uintptr, v6 bool) error {
+	if err := setsockoptInt(fd, syscall.SOL_IP, syscall.IP_TRANSPARENT, 1); err != nil {
+		return err
+	}
+	if v6 {
+		return setsockoptInt(fd, syscall.SOL_IPV6, ipv6Transparent, 1)
+	}
+	return nil
+}
+
+// originalDst returns the destination of a connection before it was
+// redirected by netfilter.  The getsockopt helpers for structures of a
+// suitable size are used to retrieve the raw sockaddr.
+func originalDst(fd uintptr, v6 bool) (*net.TCPAddr, error) {
+	if v6 {
+		info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, soOriginalDst)
+		if err != nil {
+			return nil, os.NewSyscallError("getsockopt", err)
+		}
+		port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, info.Addr.Addr[:])
+		return &net.TCPAddr{IP: ip, Port: int(port[0])<<8 | int(port[1])}, nil
+	}
+
+	mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst)
+	if err != nil {
+		return nil, os.NewSyscallError("getsockopt", err)
+	}
+	// The sockaddr_in is in mreq.Multiaddr
+	raw := mreq.Multiaddr
+	ip := net.IPv4(raw[4], raw[5], raw[6], raw[7])
+	return &net.TCPAddr{IP: ip, Port: int(raw[2])<<8 | int(raw[3])}, nil
+}
@@ -0,0 +1,47 @@
+// +build !linux
+
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+func bindToDevice(fd uintptr, device string) error {
+	return fmt.Errorf("binding to a device is not supported on %s", runtime.GOOS)
+}
+
+func freeBind(fd uintptr) error {
+	return fmt.Errorf("binding to nonlocal addresses is not supported on %s", runtime.GOOS)
+}
+
+func fastOpen(fd uintptr, qlen int) error {
+	return fmt.Errorf("TCP fast open is not supported on %s", runtime.GOOS)
+}
+
+func reusePort(fd uintptr) error {
+	return fmt.Errorf("SO_REUSEPORT is not supported on %s", runtime.GOOS)
+}
+
+func transparent(fd uintptr, v6 bool) error {
+	return fmt.Errorf("transparent proxying is not supported on %s", runtime.GOOS)
+}
+
+func originalDst(fd uintptr, v6 bool) (*net.TCPAddr, error) {
+	return nil, fmt.Errorf("original destinations are not supported on %s", runtime.GOOS)
+}
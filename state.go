@@ -0,0 +1,100 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// transfers tracks state which is still being written to a new process.
+var transfers sync.WaitGroup
+
+type stateFlag struct {
+	flag string
+	save func(w io.Writer) error
+	load func(r io.Reader) error
+}
+
+func (s *stateFlag) String() string {
+	// The state is only ever passed over a pipe
+	return ""
+}
+
+func (s *stateFlag) Set(v string) error {
+	if len(v) == 0 || v[0] != '&' {
+		return fmt.Errorf("--%s must be an inherited &fd", s.flag)
+	}
+	fd, err := strconv.Atoi(v[1:])
+	if err != nil {
+		return fmt.Errorf("failed to parse &fd: %s", err)
+	}
+
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("&%d", fd))
+	defer f.Close()
+
+	if err := s.load(f); err != nil {
+		return fmt.Errorf("failed to load state: %s", err)
+	}
+
+	// Make sure the old process isn't left waiting to write
+	io.Copy(io.Discard, f)
+	Verbose.Printf("Inherited state from --%s", s.flag)
+	return nil
+}
+
+// file returns a pipe from which the new process can read the state.  The
+// state is written in the background, so that it can be larger than the
+// pipe's buffer; the old process waits for it to be written before exiting.
+func (s *stateFlag) file() *os.File {
+	r, w, err := os.Pipe()
+	if err != nil {
+		Fatal.Printf("failed to create pipe: %s", err)
+	}
+
+	transfers.Add(1)
+	go func() {
+		defer transfers.Done()
+		defer w.Close()
+		if err := s.save(w); err != nil {
+			Error.Printf("Failed to save state for --%s: %s", s.flag, err)
+		}
+	}()
+	return r
+}
+
+// StateFlag registers a flag with the given name which is used to hand
+// application state, such as caches, sequence numbers, or session tables,
+// to the new process during Restart.  In the old process, save is called
+// to write the state when the new process is started; in the new process,
+// load is called to read it when the flag is set.  If load returns an error,
+// flag parsing fails.  The flag is only set by Restart; if it is not set,
+// load is not called.
+//
+// Since the old process may continue serving while the new one starts,
+// save should take a consistent snapshot of the state.  The state is passed
+// over a pipe, never on the command line.
+func StateFlag(name string, save func(w io.Writer) error, load func(r io.Reader) error) {
+	s := &stateFlag{
+		flag: name,
+		save: save,
+		load: load,
+	}
+	inherit(name, s)
+	FlagSet.Var(s, name, "Inherited application state (set by Restart)")
+}
@@ -0,0 +1,669 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SupervisedEnv is the environment variable through which a Supervisor
+// passes each worker process its number, starting from 1.
+const SupervisedEnv = "DAEMON_SUPERVISED"
+
+// A Supervisor stays resident as the parent of one or more worker processes,
+// which it starts with the same flags as Restart does, and starts them again
+// if they exit unexpectedly, for environments without a service manager to
+// do so.
+//
+// If the supervisor's ListenFlags have been listened on when Supervise is
+// called, it keeps them open and passes them on to each worker, so that the
+// workers accept connections from the same sockets, and connections are
+// queued rather than refused while a worker is restarted.
+type Supervisor struct {
+	// Workers is the number of worker processes to run.  If it is zero,
+	// one is run, unless there are Programs.
+	Workers int
+
+	// Programs are other commands to run and supervise.
+	Programs []*Program
+
+	// WorkersAfter names the Programs which must be ready before the workers
+	// are first started (see Program.After).
+	WorkersAfter []string
+
+	// Backoff is how long to wait before starting a worker which exited
+	// unexpectedly.  It doubles after each consecutive failure.
+	Backoff time.Duration
+
+	// MaxBackoff is the longest to wait before starting a worker.  A
+	// worker which runs for at least this long resets the backoff.
+	MaxBackoff time.Duration
+
+	// MaxRestarts, if nonzero, is the most times the workers may be
+	// restarted after exiting unexpectedly within RestartWindow.  If they
+	// crash more often than that, the supervisor gives up: it calls
+	// OnFailure, if set, shuts down the remaining workers, and exits with
+	// a nonzero status.
+	MaxRestarts   int
+	RestartWindow time.Duration
+
+	// OnFailure, if set, is called when the supervisor gives up on the
+	// workers (see MaxRestarts), with the error from the last one to exit.
+	OnFailure func(err error)
+
+	// Forward maps signals received by the supervisor to the signals which
+	// it sends to each running worker in response, in place of the usual
+	// action (see Supervise).  For instance, mapping SIGHUP to itself makes
+	// each worker restart itself rather than being restarted in turn, and
+	// mapping SIGUSR2 to itself passes it on to the workers.
+	Forward map[os.Signal]os.Signal
+
+	// ProcessGroup causes each worker to be started in its own process
+	// group, to which the supervisor sends signals, so that they also reach
+	// any processes which the worker has started.  It is not supported on
+	// windows, where signals are sent to the worker only.
+	ProcessGroup bool
+
+	// CPUs, if set, restricts each worker to a set of CPUs: worker i runs
+	// on the CPUs in CPUs[(i-1) % len(CPUs)].  It is supported on linux
+	// only.
+	CPUs [][]int
+}
+
+// NewSupervisor returns a Supervisor which runs one worker and waits one
+// second before restarting it, backing off to at most a minute.
+func NewSupervisor() *Supervisor {
+	return &Supervisor{
+		Workers:    1,
+		Backoff:    time.Second,
+		MaxBackoff: time.Minute,
+	}
+}
+
+// WorkersFlag registers a flag with the given name which sets the number of
+// worker processes run by s.  It defaults to GOMAXPROCS.
+func WorkersFlag(s *Supervisor, name string) {
+	FlagSet.IntVar(&s.Workers, name, runtime.GOMAXPROCS(0), "Number of worker processes to run")
+}
+
+// cpus returns the CPUs to which the given worker is restricted.
+func (s *Supervisor) cpus(id int) []int {
+	if len(s.CPUs) == 0 {
+		return nil
+	}
+	return s.CPUs[(id-1)%len(s.CPUs)]
+}
+
+type cpusFlag struct {
+	s *Supervisor
+}
+
+func (c cpusFlag) String() string {
+	if c.s == nil {
+		return ""
+	}
+	var sets []string
+	for _, set := range c.s.CPUs {
+		cpus := make([]string, len(set))
+		for i, cpu := range set {
+			cpus[i] = strconv.Itoa(cpu)
+		}
+		sets = append(sets, strings.Join(cpus, "+"))
+	}
+	return strings.Join(sets, ",")
+}
+
+func (c cpusFlag) Set(s string) error {
+	if s == "" {
+		c.s.CPUs = nil
+		return nil
+	}
+
+	var sets [][]int
+	for _, item := range strings.Split(s, ",") {
+		var set []int
+		for _, r := range strings.Split(item, "+") {
+			lo, hi := r, r
+			if i := strings.Index(r, "-"); i >= 0 {
+				lo, hi = r[:i], r[i+1:]
+			}
+			first, err := strconv.Atoi(lo)
+			if err != nil {
+				return fmt.Errorf("bad CPU %q", lo)
+			}
+			last, err := strconv.Atoi(hi)
+			if err != nil {
+				return fmt.Errorf("bad CPU %q", hi)
+			}
+			if first < 0 || last < first {
+				return fmt.Errorf("bad CPU range %q", r)
+			}
+			for cpu := first; cpu <= last; cpu++ {
+				set = append(set, cpu)
+			}
+		}
+		sets = append(sets, set)
+	}
+	c.s.CPUs = sets
+	return nil
+}
+
+// CPUAffinityFlag registers a flag with the given name which sets the CPUs to
+// which the workers run by s are restricted (see Supervisor.CPUs).  Its value
+// is a comma-separated list of CPU sets, one per worker, each of which is a
+// CPU number or a range of them (e.g. "2-3"), or several joined with "+".
+// For example, "0,1,2,3" runs each of four workers on its own CPU, and
+// "0-1,2-3" runs two workers on two CPUs each.
+func CPUAffinityFlag(s *Supervisor, name string) {
+	FlagSet.Var(cpusFlag{s}, name, "CPUs on which to run each worker (e.g. 0,1,2-3)")
+}
+
+// IsWorker returns whether the process was started by a Supervisor.
+func (s *Supervisor) IsWorker() bool {
+	return Worker() > 0
+}
+
+var worker, _ = strconv.Atoi(os.Getenv(SupervisedEnv))
+
+// Worker returns the number of the worker process, starting from 1, if it
+// was started by a Supervisor, or zero otherwise.
+func Worker() int {
+	return worker
+}
+
+// A supervised is a worker process or Program run by a Supervisor.
+type supervised struct {
+	id       int
+	prog     *Program      // nil for a worker
+	deps     []*supervised // to be ready before it is first started
+	cmd      *exec.Cmd     // nil while waiting to be started
+	started  time.Time     // zero until it is first started
+	backoff  time.Duration
+	ready    bool // set once it has first become ready
+	restart  bool // set if the supervisor stopped it to restart it
+	stopping bool // set if the supervisor stopped it to shut down
+	done     bool // set if it exited of its own accord and won't be restarted
+}
+
+func (w *supervised) String() string {
+	if w.prog != nil {
+		return "program " + w.prog.Name
+	}
+	return "worker " + strconv.Itoa(w.id)
+}
+
+// title returns the name of w for the beginning of a log message.
+func (w *supervised) title() string {
+	s := w.String()
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+// policy returns when w is restarted after it exits.
+func (w *supervised) policy() RestartPolicy {
+	if w.prog != nil {
+		return w.prog.Restart
+	}
+	return RestartOnFailure
+}
+
+// A readyEvent reports that the process of a program is ready.
+type readyEvent struct {
+	w   *supervised
+	cmd *exec.Cmd
+}
+
+// An exit reports that the process of a worker has exited, or failed to
+// start, in which case cmd is nil.
+type exit struct {
+	w   *supervised
+	cmd *exec.Cmd
+	err error
+}
+
+func (e exit) String() string {
+	if e.err != nil {
+		return e.err.Error()
+	}
+	return e.cmd.ProcessState.String()
+}
+
+// status returns the exit status of the process, or 1 if it failed to start.
+func (e exit) status() int {
+	if e.cmd == nil {
+		return 1
+	}
+	return e.cmd.ProcessState.ExitCode()
+}
+
+// Supervise returns immediately in a worker process.  Otherwise, it starts
+// the workers and Programs and supervises them, and does not return.
+//
+// Shutdown signals are forwarded to the workers, and the supervisor exits
+// once they have all exited.  On a restart signal, the workers are restarted
+// one at a time: each is sent a shutdown signal, and a new one is started as
+// soon as it exits, before the next is restarted.  If a worker exits with a
+// nonzero status for any other reason, a new one is started after the
+// backoff, unless the restart budget is exhausted (see MaxRestarts).  Stack
+// dump and reload signals are forwarded to the workers.
+// Restart signals should be sent to the supervisor, since a worker
+// which restarts itself would leave it.  Other signals can be forwarded to
+// the workers with Forward.
+//
+// Programs are handled like workers, except that they are restarted
+// according to their RestartPolicy, and that stack dump and reload signals
+// are not forwarded to them.  The supervisor exits once all of the workers
+// and programs have exited of their own accord and won't be restarted.
+// Whenever it exits, it first calls the AtExit hooks and removes the pidfile,
+// as Shutdown does, and a status set by SetExitCode overrides a zero one.
+//
+// Workers and programs are first started once those they depend on (see
+// Program.After) are ready, and on shutdown, they are sent the signal only
+// once those which depend on them have exited.  A second shutdown signal is
+// sent to all of them at once.
+func (s *Supervisor) Supervise() {
+	if s.IsWorker() {
+		return
+	}
+
+	sigs := handledSignals()
+	for sig := range s.Forward {
+		sigs = append(sigs, sig)
+	}
+	incoming := make(chan os.Signal, 10)
+	signal.Notify(incoming, sigs...)
+	startReaping()
+
+	exited := make(chan exit)
+	readied := make(chan readyEvent)
+	respawn := make(chan *supervised)
+	running := 0
+	start := func(w *supervised) {
+		running++
+		w.restart, w.stopping = false, false
+		if w.prog != nil {
+			cmd, ready, logged, err := s.startProgram(w.prog)
+			if err != nil {
+				Error.Printf("Failed to start %s: %s", w, err)
+				w.cmd, w.started = nil, time.Now()
+				go func() { exited <- exit{w, nil, err} }()
+				return
+			}
+			Info.Printf("Started %s (pid %d)", w, cmd.Process.Pid)
+
+			w.cmd, w.started = cmd, time.Now()
+			if ready != nil {
+				go func() {
+					if readReady(ready) {
+						readied <- readyEvent{w, cmd}
+					}
+				}()
+			} else {
+				w.ready = true
+			}
+			go func() {
+				err := cmd.Wait()
+				select {
+				case <-logged:
+				case <-time.After(outputDrainTimeout):
+				}
+				exited <- exit{w, cmd, err}
+			}()
+			return
+		}
+
+		cmd, _, _ := copyFlags(os.Args[0], false, false)
+		if cmd.Env == nil {
+			cmd.Env = os.Environ()
+		}
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%d", SupervisedEnv, w.id))
+		if s.ProcessGroup {
+			setProcessGroup(cmd) // provided in OS-specific files
+		}
+		if err := withAffinity(s.cpus(w.id), func() { spawn(cmd) }); err != nil {
+			Warning.Printf("Failed to set CPU affinity of worker %d: %s", w.id, err)
+			spawn(cmd)
+		}
+		closeFiles(cmd)
+		Info.Printf("Started %s (pid %d)", w, cmd.Process.Pid)
+
+		w.cmd, w.started, w.ready = cmd, time.Now(), true
+		go func() {
+			err := cmd.Wait()
+			exited <- exit{w, cmd, err}
+		}()
+	}
+
+	n := s.Workers
+	if n <= 0 && len(s.Programs) == 0 {
+		n = 1
+	}
+	var workers []*supervised // including programs
+	for i := 0; i < n; i++ {
+		workers = append(workers, &supervised{id: i + 1, backoff: s.Backoff})
+	}
+	for _, p := range s.Programs {
+		workers = append(workers, &supervised{prog: p, backoff: s.Backoff})
+	}
+	s.resolveDeps(workers)
+
+	// launch first starts each process which is not waiting for others to
+	// become ready.
+	launch := func() {
+		for progress := true; progress; {
+			progress = false
+			for _, w := range workers {
+				if !w.started.IsZero() || w.done {
+					continue
+				}
+				switch dep := w.waitingFor(); {
+				case dep == nil:
+					start(w)
+					progress = true
+				case dep.done && !dep.ready:
+					Error.Printf("Not starting %s: %s exited before becoming ready", w, dep)
+					w.done = true
+					progress = true
+				}
+			}
+		}
+	}
+	launch()
+	notifyReady()
+
+	var rolling []*supervised // workers waiting to be restarted
+	var crashes []time.Time   // unexpected exits within the RestartWindow
+	var shutdown bool
+	var stopSig os.Signal // sent to each process in turn during shutdown
+	code := 0
+	for {
+		select {
+		case r := <-readied:
+			if r.w.cmd != r.cmd || r.w.ready {
+				break
+			}
+			Info.Printf("%s is ready", r.w.title())
+			r.w.ready = true
+			if !shutdown {
+				launch()
+			}
+		case e := <-exited:
+			w := e.w
+			w.cmd = nil
+			running--
+			switch {
+			case shutdown:
+				Info.Printf("%s exited (%s)", w.title(), e)
+				if c := e.status(); c != 0 {
+					code = c
+				}
+				if running == 0 {
+					Info.Printf("Shutdown complete")
+					exitProcess(code)
+				}
+				s.stopNext(workers, stopSig)
+			case w.restart:
+				w.backoff = s.Backoff
+				start(w)
+				rolling = s.rollNext(rolling)
+			case e.err == nil && w.policy() != RestartAlways:
+				Info.Printf("%s exited (%s)", w.title(), e)
+				w.done = true
+				launch()
+				if allDone(workers) {
+					Info.Printf("Shutdown complete")
+					exitProcess(code)
+				}
+			case w.policy() == RestartNever:
+				Error.Printf("%s exited (%s); not restarting", w.title(), e)
+				w.done, code = true, e.status()
+				launch()
+				if allDone(workers) {
+					Info.Printf("Shutdown complete")
+					exitProcess(code)
+				}
+			case s.crashLoop(&crashes):
+				Error.Printf("%s exited (%s); giving up after %d restarts in %s", w.title(), e, s.MaxRestarts, s.RestartWindow)
+				if s.OnFailure != nil {
+					err := e.err
+					if err == nil {
+						err = fmt.Errorf("%s exited (%s)", w, e)
+					}
+					s.OnFailure(err)
+				}
+				if running == 0 {
+					exitProcess(1)
+				}
+				shutdown, rolling, code, stopSig = true, nil, 1, shutdownSignal()
+				s.stopNext(workers, stopSig)
+			default:
+				if time.Since(w.started) >= s.MaxBackoff {
+					w.backoff = s.Backoff
+				}
+				Error.Printf("%s exited (%s); restarting in %s", w.title(), e, w.backoff)
+				time.AfterFunc(w.backoff, func() { respawn <- w })
+				if w.backoff *= 2; w.backoff > s.MaxBackoff {
+					w.backoff = s.MaxBackoff
+				}
+			}
+		case w := <-respawn:
+			if shutdown || w.cmd != nil {
+				break
+			}
+			start(w)
+		case sig := <-incoming:
+			if fwd, ok := s.Forward[sig]; ok {
+				if shutdown {
+					break
+				}
+				for _, w := range workers {
+					if w.cmd != nil {
+						s.signalWorker(w, fwd)
+					}
+				}
+				break
+			}
+			switch sigAction(sig) {
+			case ActionShutdown:
+				if running == 0 {
+					Info.Printf("Shutdown complete")
+					exitProcess(1)
+				}
+				if shutdown {
+					// Stop everything without waiting
+					for _, w := range workers {
+						if w.cmd != nil {
+							s.signalWorker(w, sig)
+						}
+					}
+					break
+				}
+				shutdown, rolling, stopSig = true, nil, sig
+				notify("STOPPING=1")
+				s.stopNext(workers, stopSig)
+			case ActionRestart:
+				if shutdown {
+					Info.Printf("Ignoring %s during shutdown", sig)
+					break
+				}
+				if len(rolling) > 0 || restarting(workers) {
+					Info.Printf("Ignoring %s: restart already in progress", sig)
+					break
+				}
+				rolling = s.rollNext(append([]*supervised(nil), workers...))
+			case ActionStackDump, ActionReload:
+				for _, w := range workers {
+					if w.cmd != nil && w.prog == nil {
+						s.signalWorker(w, sig)
+					}
+				}
+			default:
+				Warning.Printf("Unknown signal: %s", sig)
+			}
+		}
+	}
+}
+
+// rollNext sends a shutdown signal to the next running worker in rolling so
+// that it is restarted, and returns the workers after it.
+func (s *Supervisor) rollNext(rolling []*supervised) []*supervised {
+	for len(rolling) > 0 {
+		w := rolling[0]
+		rolling = rolling[1:]
+		if w.cmd == nil {
+			// Waiting to be started again, or done
+			continue
+		}
+		Info.Printf("Restarting %s", w)
+		w.restart = true
+		s.signalWorker(w, shutdownSignal())
+		return rolling
+	}
+	return nil
+}
+
+// resolveDeps resolves the names of the programs on which each of the
+// workers and programs depends.
+func (s *Supervisor) resolveDeps(workers []*supervised) {
+	byName := map[string]*supervised{}
+	for _, w := range workers {
+		if w.prog != nil {
+			byName[w.prog.Name] = w
+		}
+	}
+	for _, w := range workers {
+		names := s.WorkersAfter
+		if w.prog != nil {
+			names = w.prog.After
+		}
+		for _, name := range names {
+			dep, ok := byName[name]
+			if !ok {
+				Fatal.Printf("%s depends on unknown program %q", w.title(), name)
+			}
+			w.deps = append(w.deps, dep)
+		}
+	}
+
+	// Check for cycles, which would prevent their programs from starting
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := map[*supervised]int{}
+	var visit func(w *supervised)
+	visit = func(w *supervised) {
+		switch state[w] {
+		case visiting:
+			Fatal.Printf("Dependency cycle involving %s", w)
+		case visited:
+			return
+		}
+		state[w] = visiting
+		for _, dep := range w.deps {
+			visit(dep)
+		}
+		state[w] = visited
+	}
+	for _, w := range workers {
+		visit(w)
+	}
+}
+
+// waitingFor returns one of the processes which must become ready before w
+// is first started, or nil if there are none.
+func (w *supervised) waitingFor() *supervised {
+	for _, dep := range w.deps {
+		if !dep.ready {
+			return dep
+		}
+	}
+	return nil
+}
+
+// stopNext sends sig to each running process which no other running process
+// depends on, unless it has already been sent it.
+func (s *Supervisor) stopNext(workers []*supervised, sig os.Signal) {
+	dependedOn := map[*supervised]bool{}
+	for _, w := range workers {
+		if w.cmd != nil {
+			for _, dep := range w.deps {
+				dependedOn[dep] = true
+			}
+		}
+	}
+	for _, w := range workers {
+		if w.cmd != nil && !w.stopping && !dependedOn[w] {
+			w.stopping = true
+			s.signalWorker(w, sig)
+		}
+	}
+}
+
+// crashLoop records an unexpected exit of a worker in crashes, and returns
+// whether the workers have exhausted their restart budget.
+func (s *Supervisor) crashLoop(crashes *[]time.Time) bool {
+	if s.MaxRestarts <= 0 {
+		return false
+	}
+	now := time.Now()
+	recent := append(*crashes, now)
+	for len(recent) > 0 && now.Sub(recent[0]) > s.RestartWindow {
+		recent = recent[1:]
+	}
+	*crashes = recent
+	return len(recent) > s.MaxRestarts
+}
+
+// allDone returns whether all of the workers have exited and won't be
+// restarted.
+func allDone(workers []*supervised) bool {
+	for _, w := range workers {
+		if !w.done {
+			return false
+		}
+	}
+	return true
+}
+
+// restarting returns whether any of the workers is being restarted.
+func restarting(workers []*supervised) bool {
+	for _, w := range workers {
+		if w.restart {
+			return true
+		}
+	}
+	return false
+}
+
+// signalWorker sends sig to the worker's process, or its process group if
+// ProcessGroup is set, killing it if the signal cannot be delivered.
+func (s *Supervisor) signalWorker(w *supervised, sig os.Signal) {
+	send := w.cmd.Process.Signal
+	if s.ProcessGroup {
+		send = func(sig os.Signal) error { return signalGroup(w.cmd.Process, sig) }
+	}
+	if err := send(sig); err != nil {
+		Warning.Printf("Failed to signal %s: %s; killing it", w, err)
+		w.cmd.Process.Kill()
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SyslogOnly, if set, causes log messages to be sent only to syslog once
+// Syslog has been called, rather than also to standard error and the
+// LogFileFlag file.
+var SyslogOnly = false
+
+// syslogFacilities are the codes of the syslog facilities.
+var syslogFacilities = map[string]int{
+	"kern":     0,
+	"user":     1,
+	"mail":     2,
+	"daemon":   3,
+	"auth":     4,
+	"syslog":   5,
+	"lpr":      6,
+	"news":     7,
+	"uucp":     8,
+	"cron":     9,
+	"authpriv": 10,
+	"ftp":      11,
+	"local0":   16,
+	"local1":   17,
+	"local2":   18,
+	"local3":   19,
+	"local4":   20,
+	"local5":   21,
+	"local6":   22,
+	"local7":   23,
+}
+
+type syslogFlag struct {
+	value string
+}
+
+func (f *syslogFlag) String() string {
+	return f.value
+}
+
+func (f *syslogFlag) Set(s string) error {
+	facility, tag, _ := strings.Cut(s, ":")
+	if err := Syslog(facility, tag); err != nil {
+		return err
+	}
+	f.value = s
+	return nil
+}
+
+// SyslogFlag registers a flag with the given name which, when set to the name
+// of a syslog facility (such as "daemon" or "local0"), optionally followed by
+// a colon and a tag (as in "local0:myapp"), calls Syslog with them.
+func SyslogFlag(name string) {
+	FlagSet.Var(&syslogFlag{}, name, "Syslog facility[:tag] to which to send logs")
+}
+
+// Syslog severities, which are also used by the journal and the event log.
+const (
+	sevCrit    = 2
+	sevErr     = 3
+	sevWarning = 4
+	sevInfo    = 6
+	sevDebug   = 7
+)
+
+// severity returns the syslog severity of messages logged at l.
+func severity(l Logger) int {
+	switch {
+	case l == noLevel:
+		return sevInfo
+	case l == Fatal:
+		return sevCrit
+	case l <= Error:
+		return sevErr
+	case l == Warning:
+		return sevWarning
+	case l == Info:
+		return sevInfo
+	}
+	return sevDebug
+}
+
+// withSource returns the message of e prefixed by the file and line which
+// logged it, as it is sent to syslog and the like.
+func withSource(e *logEntry) string {
+	return fmt.Sprintf("%s:%d: %s", e.file, e.line, e.msg)
+}
@@ -0,0 +1,62 @@
+// +build linux darwin
+
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"log/syslog"
+)
+
+// Syslog causes log messages to be sent to the local syslog daemon, with the
+// given facility (such as "daemon" or "local0") and tag (or the program name,
+// if it is empty), in addition to standard error and the LogFileFlag file
+// (unless SyslogOnly is set).  Messages are sent regardless of the LogFormat,
+// with the file and line which logged them.  Fatal becomes the crit severity,
+// Error (and Exit) err, Warning warning, Info (and the output of programs)
+// info, and Verbose debug.
+func Syslog(facility, tag string) error {
+	fac, ok := syslogFacilities[facility]
+	if !ok {
+		return fmt.Errorf("unknown syslog facility %q", facility)
+	}
+	w, err := syslog.New(syslog.Priority(fac<<3)|syslog.LOG_INFO, tag)
+	if err != nil {
+		return fmt.Errorf("failed to connect to syslog: %s", err)
+	}
+	addLogSink(logSink{
+		write: func(e *logEntry) { writeSyslog(w, e) },
+		only:  &SyslogOnly,
+	})
+	return nil
+}
+
+// writeSyslog writes e to w with the severity corresponding to its level.
+func writeSyslog(w *syslog.Writer, e *logEntry) {
+	msg := withSource(e)
+	switch severity(e.level) {
+	case sevCrit:
+		w.Crit(msg)
+	case sevErr:
+		w.Err(msg)
+	case sevWarning:
+		w.Warning(msg)
+	case sevInfo:
+		w.Info(msg)
+	default:
+		w.Debug(msg)
+	}
+}
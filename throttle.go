@@ -0,0 +1,138 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"sync"
+	"time"
+)
+
+// maxChunk is the largest amount of data that a throttled connection will
+// read or write at once.
+const maxChunk = 32 * 1024
+
+// A rateLimiter is a token bucket which limits the rate of bytes transferred,
+// allowing bursts of up to one second's worth of data.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	tokens float64 // negative if bytes have been taken on credit
+	last   time.Time
+}
+
+// newRateLimiter returns a rateLimiter for the given rate, or nil if the
+// rate is not positive.
+func newRateLimiter(bps int64) *rateLimiter {
+	if bps <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		rate:   float64(bps),
+		tokens: float64(bps),
+		last:   time.Now(),
+	}
+}
+
+// take removes n bytes from the bucket and returns how long the caller
+// must wait before transferring them.
+func (r *rateLimiter) take(n int) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	r.tokens += now.Sub(r.last).Seconds() * r.rate
+	if r.tokens > r.rate {
+		r.tokens = r.rate
+	}
+	r.last = now
+
+	r.tokens -= float64(n)
+	if r.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-r.tokens / r.rate * float64(time.Second))
+}
+
+// A throttle is a set of rate limiters which all apply to a transfer.
+type throttle []*rateLimiter
+
+// chunk returns the largest amount of data which should be transferred at
+// once, so that the transfer is smooth.
+func (t throttle) chunk() int {
+	n := maxChunk
+	for _, r := range t {
+		if int(r.rate) < n {
+			n = int(r.rate)
+		}
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// wait waits until n bytes may be transferred.
+func (t throttle) wait(n int) {
+	var delay time.Duration
+	for _, r := range t {
+		if d := r.take(n); d > delay {
+			delay = d
+		}
+	}
+	time.Sleep(delay)
+}
+
+// throttles returns the throttles for reading and writing on a new
+// connection, or nil if they are unlimited.
+func (w *WaitListener) throttles() (read, write throttle) {
+	w.rateOnce.Do(func() {
+		w.readRate = newRateLimiter(w.Rate)
+		w.writeRate = newRateLimiter(w.Rate)
+	})
+	for _, r := range []*rateLimiter{w.readRate, newRateLimiter(w.ConnRate)} {
+		if r != nil {
+			read = append(read, r)
+		}
+	}
+	for _, r := range []*rateLimiter{w.writeRate, newRateLimiter(w.ConnRate)} {
+		if r != nil {
+			write = append(write, r)
+		}
+	}
+	return read, write
+}
+
+// BandwidthFlags registers two flags with the given names which, when set,
+// limit the bandwidth (in bytes per second, in each direction) of each
+// connection accepted from l and of all of them together, respectively.
+// See WaitListener.ConnRate and WaitListener.Rate.  If either name is
+// empty, that flag is not registered.
+func BandwidthFlags(l Listenable, connName, totalName string) {
+	c, ok := l.(configurable)
+	if !ok {
+		Fatal.Printf("cannot configure bandwidth for %T", l)
+	}
+
+	var conn, total int64
+	if connName != "" {
+		FlagSet.Int64Var(&conn, connName, 0, "Bandwidth limit per connection in bytes/sec (0 for unlimited)")
+	}
+	if totalName != "" {
+		FlagSet.Int64Var(&total, totalName, 0, "Bandwidth limit for all connections in bytes/sec (0 for unlimited)")
+	}
+	c.configure(func(w *WaitListener) {
+		w.ConnRate, w.Rate = conn, total
+	})
+}
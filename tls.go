@@ -0,0 +1,110 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+type ticketFlag struct {
+	flag   string
+	config *tls.Config
+	keys   [][32]byte
+}
+
+func (t *ticketFlag) String() string {
+	// The keys are secret, so they are never passed on the command line
+	return ""
+}
+
+func (t *ticketFlag) Set(s string) error {
+	if len(s) == 0 || s[0] != '&' {
+		return fmt.Errorf("--%s must be an inherited &fd", t.flag)
+	}
+	fd, err := strconv.Atoi(s[1:])
+	if err != nil {
+		return fmt.Errorf("failed to parse &fd: %s", err)
+	}
+
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("&%d", fd))
+	defer f.Close()
+
+	var keys [][32]byte
+	for {
+		var key [32]byte
+		if _, err := io.ReadFull(f, key[:]); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("failed to read session ticket keys: %s", err)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no session ticket keys inherited")
+	}
+	t.setKeys(keys)
+	Verbose.Printf("Inherited %d TLS session ticket key(s)", len(keys))
+	return nil
+}
+
+func (t *ticketFlag) setKeys(keys [][32]byte) {
+	t.keys = keys
+	t.config.SetSessionTicketKeys(keys)
+}
+
+// file returns a pipe from which the new process can read the keys.
+func (t *ticketFlag) file() *os.File {
+	r, w, err := os.Pipe()
+	if err != nil {
+		Fatal.Printf("failed to create pipe: %s", err)
+	}
+	defer w.Close()
+
+	// The keys are small enough that they fit in the pipe's buffer
+	for _, key := range t.keys {
+		if _, err := w.Write(key[:]); err != nil {
+			Fatal.Printf("failed to write session ticket keys: %s", err)
+		}
+	}
+	return r
+}
+
+// SessionTicketKeysFlag registers a flag with the given name which is used to
+// hand the TLS session ticket keys for config to the new process during
+// Restart, so that clients can continue to resume their sessions.  The flag
+// is only set by Restart; if it is not set, a new random key is generated.
+// The keys are passed over a pipe, never on the command line.
+//
+// SessionTicketKeysFlag calls config.SetSessionTicketKeys, so the keys are
+// not rotated automatically.
+func SessionTicketKeysFlag(name string, config *tls.Config) {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		Fatal.Printf("failed to generate session ticket key: %s", err)
+	}
+
+	t := &ticketFlag{
+		flag:   name,
+		config: config,
+	}
+	t.setKeys([][32]byte{key})
+	inherit(name, t)
+	FlagSet.Var(t, name, "Inherited TLS session ticket keys (set by Restart)")
+}
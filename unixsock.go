@@ -0,0 +1,129 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// UnixOptions specifies the ownership and permissions of a Unix domain
+// socket file created by a Listenable.
+type UnixOptions struct {
+	Mode  os.FileMode // Permissions for the socket file (if nonzero)
+	Owner string      // User name or ID to own the socket file (if set)
+	Group string      // Group name or ID to own the socket file (if set)
+}
+
+// removeStale removes the socket file at path if nothing is listening on it.
+// A socket which is still accepting connections is left alone, so that the
+// subsequent bind fails as it should.
+func removeStale(netw, path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	conn, err := net.Dial(netw, path)
+	if err == nil {
+		conn.Close()
+		return nil
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return nil
+	}
+
+	Info.Printf("Removing stale socket: %s", path)
+	return os.Remove(path)
+}
+
+// listenUnix creates a Unix domain socket listener and applies opts to
+// the socket file.
+func listenUnix(netw string, addr *net.UnixAddr, opts UnixOptions) (net.Listener, error) {
+	path := addr.Name
+	abstract := len(path) > 0 && path[0] == '@'
+	if !abstract {
+		if err := removeStale(netw, path); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.ListenUnix(netw, addr)
+	if err != nil {
+		return nil, err
+	}
+	if abstract {
+		return l, nil
+	}
+
+	if opts.Mode != 0 {
+		if err := os.Chmod(path, opts.Mode); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	if opts.Owner != "" || opts.Group != "" {
+		uid, gid, err := lookupOwner(opts.Owner, opts.Group)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		if err := os.Lchown(path, uid, gid); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// lookupOwner resolves the given user and group names (or IDs) to IDs,
+// returning -1 for those which are unset.
+func lookupOwner(owner, group string) (uid, gid int, err error) {
+	uid, gid = -1, -1
+	if owner != "" {
+		if uid, err = strconv.Atoi(owner); err != nil {
+			usr, err := user.Lookup(owner)
+			if err != nil {
+				return -1, -1, fmt.Errorf("failed to find user %q: %s", owner, err)
+			}
+			if uid, err = strconv.Atoi(usr.Uid); err != nil {
+				return -1, -1, fmt.Errorf("bad user ID %q: %s", usr.Uid, err)
+			}
+		}
+	}
+	if group != "" {
+		if gid, err = strconv.Atoi(group); err != nil {
+			grp, err := user.LookupGroup(group)
+			if err != nil {
+				return -1, -1, fmt.Errorf("failed to find group %q: %s", group, err)
+			}
+			if gid, err = strconv.Atoi(grp.Gid); err != nil {
+				return -1, -1, fmt.Errorf("bad group ID %q: %s", grp.Gid, err)
+			}
+		}
+	}
+	return uid, gid, nil
+}
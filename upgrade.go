@@ -0,0 +1,290 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ReadyEnv is the environment variable through which a new process started
+// by Restart or an Upgrader is given the file descriptor on which to report
+// that it is ready.
+const ReadyEnv = "DAEMON_READY_FD"
+
+// ReadyTimeout, if nonzero, causes Restart to keep serving until the new
+// process reports that it is ready (see Ready) before it stops its
+// listeners.  If the new process exits or doesn't become ready within the
+// timeout, it is killed and this process continues serving.
+var ReadyTimeout time.Duration
+
+// WatchChild, if nonzero, causes Restart to stand by for the given duration
+// after the new process has started (and become ready, if ReadyTimeout is
+// set) before it stops its listeners and begins draining.  During that time
+// it doesn't accept connections, but if the new process exits, it resumes
+// accepting them and continues serving.
+var WatchChild time.Duration
+
+var (
+	readyOnce   sync.Once
+	readyErr    error
+	manualReady bool // set if an Upgrader has been created
+)
+
+// Ready reports to the old process, if any, that this process is ready, so
+// that it can stop accepting connections and exit.  Run calls Ready unless
+// an Upgrader has been created, in which case it must be called explicitly.
+// Only the first call has any effect.  If AutoDetect is set, it also reports
+// to systemd that this is now the ready main process of the service.
+func Ready() error {
+	readyOnce.Do(func() {
+		defer notifyReady()
+
+		env := os.Getenv(ReadyEnv)
+		os.Unsetenv(ReadyEnv)
+		if env == "" {
+			return
+		}
+
+		fd, err := strconv.Atoi(env)
+		if err != nil {
+			readyErr = fmt.Errorf("bad %s %q: %s", ReadyEnv, env, err)
+			return
+		}
+		f := os.NewFile(uintptr(fd), "ready")
+		defer f.Close()
+		if _, err := f.Write([]byte(readyMessage())); err != nil {
+			readyErr = fmt.Errorf("failed to report readiness: %s", err)
+			return
+		}
+		Verbose.Printf("Reported readiness to parent process")
+	})
+	return readyErr
+}
+
+// startReady starts cmd with a pipe on which it can report that it is
+// ready, and returns the read end of the pipe.
+func startReady(cmd *exec.Cmd) (*os.File, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pipe: %s", err)
+	}
+	defer w.Close()
+
+	cmd.ExtraFiles = append(cmd.ExtraFiles, w)
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%d", ReadyEnv, 3+len(cmd.ExtraFiles)-1))
+
+	if err := start(cmd); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// waitReady waits up to timeout (or indefinitely, if it is zero) for the
+// new process started by cmd to report readiness on r, and closes r.  Once
+// it is ready, its version is checked with AcceptVersion.
+func waitReady(cmd *exec.Cmd, r *os.File, timeout time.Duration) error {
+	pid := cmd.Process.Pid
+	ready := make(chan error, 1)
+	go func() {
+		defer r.Close()
+		line, err := bufio.NewReader(r).ReadString('\n')
+		if err != nil {
+			// The write end is closed when the new process exits
+			ready <- fmt.Errorf("new process %d exited before becoming ready: %s", pid, cmd.Wait())
+			return
+		}
+		version, err := parseReady(line)
+		if err == nil && AcceptVersion != nil {
+			if err = AcceptVersion(Version, version); err != nil {
+				err = fmt.Errorf("refused new process %d (version %q): %s", pid, version, err)
+			}
+		}
+		ready <- err
+	}()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case err := <-ready:
+		return err
+	case <-expired:
+		return fmt.Errorf("new process %d not ready after %s", pid, timeout)
+	}
+}
+
+// watchChild waits for d, returning an error if the process started by cmd
+// exits in the meantime.
+func watchChild(cmd *exec.Cmd, d time.Duration) error {
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	Verbose.Printf("Watching new process %d for %s", cmd.Process.Pid, d)
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case err := <-exited:
+		if err == nil {
+			err = errors.New("exit status 0")
+		}
+		return fmt.Errorf("new process %d exited: %s", cmd.Process.Pid, err)
+	case <-timer.C:
+		return nil
+	}
+}
+
+// rollback kills the new process started by cmd, which failed to become
+// ready, and releases the resources copied for it so that this process can
+// continue serving.
+func rollback(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+	recordPID(os.Getpid())
+	closeFiles(cmd)
+	stopOnce <- true
+}
+
+// An Upgrader restarts the process like Restart, except that the old process
+// keeps serving until the new one reports that it is ready, so that a new
+// process which fails during startup doesn't take the service down with it.
+//
+// In the old process, Upgrade starts the new one.  In the new process, Ready
+// must be called once it has successfully listened and is prepared to serve.
+type Upgrader struct {
+	// Path, if set, is the binary to run in place of the current one.
+	Path string
+
+	// Timeout is how long Upgrade waits for the new process to become
+	// ready.  If it is zero, Upgrade waits indefinitely.
+	Timeout time.Duration
+
+	// Drain is how long the old process waits for its connections to
+	// close once the new process is ready.
+	Drain time.Duration
+
+	// Watch, if nonzero, is how long the old process stands by after the
+	// new one is ready, as with WatchChild, before it begins draining.
+	Watch time.Duration
+}
+
+// NewUpgrader returns an Upgrader which waits up to a minute for the new
+// process to become ready and then waits up to LameDuck for connections to
+// the old one to close.  Once an Upgrader has been created, Run no longer
+// calls Ready automatically.
+func NewUpgrader() *Upgrader {
+	manualReady = true
+	return &Upgrader{
+		Timeout: time.Minute,
+		Drain:   LameDuck,
+	}
+}
+
+// HasParent returns whether the process was started by Upgrade, and so
+// should call Ready when it is ready.
+func (u *Upgrader) HasParent() bool {
+	return os.Getenv(ReadyEnv) != ""
+}
+
+// Ready calls Ready.
+func (u *Upgrader) Ready() error {
+	return Ready()
+}
+
+// Upgrade starts a new copy of the process as Restart does and waits for it
+// to call Ready.  If it does, the old process stops accepting connections,
+// waits for its connections to close, and exits; Upgrade does not return.
+// If the binary fails verification (see VerifyBinary), or the new process
+// exits, fails to start, or doesn't become ready within the Timeout (or
+// exits during the Watch), it is killed and Upgrade returns an error, having
+// left the old process serving as before.
+func (u *Upgrader) Upgrade() error {
+	<-stopOnce
+
+	path := u.Path
+	if path == "" {
+		path = os.Args[0]
+	}
+	bin, err := checkBinary(path)
+	if err != nil {
+		stopOnce <- true
+		return err
+	}
+	runHooks(&restartHooks, false)
+	cmd, ports, packets := copyFlags(path, false, false)
+	if err := runVerified(cmd, bin, false); err != nil { // provided in OS-specific files
+		closeFiles(cmd)
+		stopOnce <- true
+		return err
+	}
+	passPIDFile(cmd, false)
+	nextGeneration(cmd)
+	r, err := startReady(cmd)
+	if err != nil {
+		closeFiles(cmd)
+		stopOnce <- true
+		return err
+	}
+	if err := waitReady(cmd, r, u.Timeout); err != nil {
+		rollback(cmd)
+		return err
+	}
+	Info.Printf("New process %d is ready", cmd.Process.Pid)
+	recordPID(cmd.Process.Pid)
+	closeFiles(cmd)
+
+	if u.Watch > 0 {
+		// Stop accepting, but stand by in case the new process fails
+		ports.pause()
+		if err := watchChild(cmd, u.Watch); err != nil {
+			ports.resume()
+			rollback(cmd)
+			return err
+		}
+	}
+
+	lameDuck()
+	ports.Stop()
+	beginDrain(ports, u.Drain)
+	for _, p := range packets {
+		p.Close()
+	}
+
+	// Wait for all connections to close out
+	err = ports.drain(u.Drain)
+	transfers.Wait()
+	relistens.Wait()
+	runHooks(&shutdownHooks, true)
+	if err != nil {
+		Fatal.Printf("Upgrade timed out after %s", u.Drain)
+	}
+	Verbose.Printf("Upgrade complete")
+	exitProcess(0)
+	panic("unreachable")
+}
@@ -0,0 +1,138 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// VerifyChecksum, if set, causes RestartExec and Upgrade to refuse to run a
+// binary unless it matches the SHA-256 checksum in the file with the same
+// path plus ".sha256", which is in the format written by sha256sum.
+var VerifyChecksum = false
+
+// BinaryKey, if set, causes RestartExec and Upgrade to refuse to run a
+// binary unless it has been signed with the corresponding Ed25519 private
+// key.  The detached signature is read from the file with the same path plus
+// ".sig", either as 64 raw bytes or base64-encoded.
+var BinaryKey ed25519.PublicKey
+
+// VerifyBinary checks the binary at path according to VerifyChecksum and
+// BinaryKey.  RestartExec and Upgrade verify a binary in the same way before
+// running it, so that the listeners are never handed to one which is corrupt
+// or has been tampered with.  They run the very file which they verified,
+// even if another has been put in its place since.
+func VerifyBinary(path string) error {
+	f, err := openBinary(path)
+	if f != nil {
+		f.Close()
+	}
+	return err
+}
+
+// openBinary opens the binary at path and verifies it as VerifyBinary does.
+// It returns the open file, so that it can be run with runVerified, or nil
+// if there is nothing to verify.
+func openBinary(path string) (*os.File, error) {
+	if !VerifyChecksum && BinaryKey == nil {
+		return nil, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	bin, err := io.ReadAll(f)
+	if err == nil {
+		err = verify(path, bin)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	Verbose.Printf("Verified binary %s", path)
+	return f, nil
+}
+
+// verify checks the contents of the binary at path.
+func verify(path string, bin []byte) error {
+	if VerifyChecksum {
+		sumfile, err := os.ReadFile(path + ".sha256")
+		if err != nil {
+			return fmt.Errorf("failed to read checksum: %s", err)
+		}
+		fields := strings.Fields(string(sumfile))
+		if len(fields) == 0 {
+			return fmt.Errorf("empty checksum file %s.sha256", path)
+		}
+		want, err := hex.DecodeString(fields[0])
+		if err != nil {
+			return fmt.Errorf("bad checksum in %s.sha256: %s", path, err)
+		}
+		if got := sha256.Sum256(bin); !bytes.Equal(got[:], want) {
+			return fmt.Errorf("checksum mismatch for %s: got %x, want %x", path, got, want)
+		}
+	}
+
+	if BinaryKey != nil {
+		sig, err := os.ReadFile(path + ".sig")
+		if err != nil {
+			return fmt.Errorf("failed to read signature: %s", err)
+		}
+		if len(sig) != ed25519.SignatureSize {
+			if sig, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig))); err != nil {
+				return fmt.Errorf("bad signature in %s.sig: %s", path, err)
+			}
+		}
+		if !ed25519.Verify(BinaryKey, bin, sig) {
+			return fmt.Errorf("bad signature for %s", path)
+		}
+	}
+	return nil
+}
+
+type keyFlag struct{}
+
+func (keyFlag) String() string {
+	return base64.StdEncoding.EncodeToString(BinaryKey)
+}
+
+func (keyFlag) Set(s string) error {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return fmt.Errorf("failed to parse key: %s", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("key is %d bytes, want %d", len(key), ed25519.PublicKeySize)
+	}
+	BinaryKey = key
+	return nil
+}
+
+// VerifyBinaryFlags registers two flags, with the given names, which set
+// VerifyChecksum and BinaryKey (as a base64-encoded Ed25519 public key)
+// respectively.
+func VerifyBinaryFlags(checksumName, keyName string) {
+	FlagSet.BoolVar(&VerifyChecksum, checksumName, false, "Verify the binary's SHA-256 checksum before restarting into it")
+	FlagSet.Var(keyFlag{}, keyName, "Base64-encoded Ed25519 public key with which binaries must be signed")
+}
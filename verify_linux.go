@@ -0,0 +1,37 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// runVerified causes cmd to run the verified binary bin (see openBinary), if
+// any, by way of its file descriptor, which is passed on to the new process,
+// so that the file which is run is the one which was verified.
+func runVerified(cmd *exec.Cmd, bin *os.File, inPlace bool) error {
+	if bin == nil {
+		return nil
+	}
+	fd := 3 + len(cmd.ExtraFiles)
+	if inPlace {
+		fd = int(bin.Fd())
+	}
+	cmd.ExtraFiles = append(cmd.ExtraFiles, bin)
+	cmd.Path = fmt.Sprintf("/proc/self/fd/%d", fd)
+	return nil
+}
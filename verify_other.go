@@ -0,0 +1,72 @@
+// +build !linux
+
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// binaryCopyEnv is the environment variable through which runVerified tells
+// the new process to remove the directory holding its copy of the binary.
+const binaryCopyEnv = "DAEMON_BINARY_COPY"
+
+func init() {
+	if dir := os.Getenv(binaryCopyEnv); dir != "" {
+		os.Unsetenv(binaryCopyEnv)
+		// This fails on windows, where a running binary can't be removed
+		os.RemoveAll(dir)
+	}
+}
+
+// runVerified causes cmd to run a private copy of the verified binary bin
+// (see openBinary), if any, so that the file which is run is the one which
+// was verified.  The new process removes the copy when it starts.
+func runVerified(cmd *exec.Cmd, bin *os.File, inPlace bool) error {
+	if bin == nil {
+		return nil
+	}
+	defer bin.Close()
+
+	dir, err := os.MkdirTemp("", "daemon-binary-")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, filepath.Base(bin.Name()))
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0700)
+	if err == nil {
+		if _, err = bin.Seek(0, io.SeekStart); err == nil {
+			_, err = io.Copy(out, bin)
+		}
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+
+	cmd.Path = path
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, binaryCopyEnv+"="+dir)
+	return nil
+}
@@ -0,0 +1,77 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// VersionEnv is the environment variable through which Restart and an
+// Upgrader pass the new process the Version of this one.
+const VersionEnv = "DAEMON_PARENT_VERSION"
+
+// Version identifies the build of the daemon, such as a release number or
+// commit hash set with the linker's -X flag.  When a new process started by
+// Restart or an Upgrader reports that it is ready (see Ready), it reports
+// its Version to this one, which passes it to AcceptVersion.
+var Version string
+
+// AcceptVersion, if set, is called by Restart and Upgraders with the Version
+// of this process and that of the new process once it is ready, before this
+// process stops serving.  If it returns an error, such as to refuse a
+// downgrade or a version which cannot read this one's state, the new process
+// is killed and this process continues serving.  Since it relies on the
+// readiness handshake, it is only called if ReadyTimeout is set (or for an
+// Upgrader), and not if ExecInPlace is set.
+var AcceptVersion func(old, new string) error
+
+// ParentVersion returns the Version of the process which started this one
+// with Restart or an Upgrader, or an empty string if there is none or it
+// didn't set a Version.  The new process can use it to refuse to take over
+// from a process whose state it cannot read, by exiting before it is ready.
+func ParentVersion() string {
+	return parentVersion
+}
+
+var parentVersion = os.Getenv(VersionEnv)
+
+// passVersion passes the Version of this process on to cmd.
+func passVersion(cmd *exec.Cmd) {
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, VersionEnv+"="+Version)
+}
+
+// readyMessage returns the message with which Ready reports readiness.
+func readyMessage() string {
+	if Version == "" {
+		return "READY\n"
+	}
+	return "READY " + Version + "\n"
+}
+
+// parseReady parses a readiness message and returns the version which it
+// reports.
+func parseReady(line string) (version string, err error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || fields[0] != "READY" {
+		return "", fmt.Errorf("bad readiness message %q", line)
+	}
+	return strings.Join(fields[1:], " "), nil
+}
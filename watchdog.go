@@ -0,0 +1,82 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// WatchdogCheck, if set, is called by Run before each keepalive it sends to
+// the systemd watchdog.  If it returns an error, the keepalive is not sent,
+// so that systemd restarts the process if it stays unhealthy for longer than
+// the WatchdogSec of its unit.
+//
+// Run sends keepalives when systemd has enabled the watchdog for the process
+// (by setting WATCHDOG_USEC), at half of the watchdog interval.  Since the
+// process started by Restart has a new PID, services which use both should
+// set NotifyAccess=all.
+var WatchdogCheck func() error
+
+// watchdogInterval returns the interval at which systemd expects keepalives
+// from this process, or zero if the watchdog is not enabled for it.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if p := os.Getenv("WATCHDOG_PID"); p != "" && p != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	// Let the process which replaces this one on Restart take over.
+	os.Unsetenv("WATCHDOG_PID")
+	return time.Duration(usec) * time.Microsecond
+}
+
+// watchdog sends keepalives to the systemd watchdog until the process exits.
+func watchdog(interval time.Duration) {
+	Verbose.Printf("Sending watchdog keepalives every %s", interval/2)
+	for range time.Tick(interval / 2) {
+		if WatchdogCheck != nil {
+			if err := WatchdogCheck(); err != nil {
+				Warning.Printf("Withholding watchdog keepalive: %s", err)
+				continue
+			}
+		}
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			Warning.Printf("Failed to send watchdog keepalive: %s", err)
+		}
+	}
+}
+
+// sdNotify sends state to the systemd notification socket, if there is one.
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	if addr[0] == '@' {
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}